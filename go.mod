@@ -5,9 +5,8 @@ go 1.16
 
 require (
 	github.com/TwiN/go-color v1.0.1
-	github.com/alicebob/miniredis/v2 v2.16.1
+	github.com/alicebob/miniredis/v2 v2.31.1
 	github.com/go-chi/chi/v5 v5.0.7
-	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/go-redis/redis/v8 v8.11.4
 	github.com/golang/mock v1.6.0
 	github.com/google/uuid v1.3.0
@@ -15,6 +14,6 @@ require (
 	github.com/onsi/ginkgo v1.16.5 // indirect
 	github.com/onsi/gomega v1.17.0 // indirect
 	github.com/stretchr/testify v1.7.0
-	github.com/yuin/gopher-lua v0.0.0-20210529063254-f4c35e4016d9 // indirect
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 )
@@ -6,8 +6,10 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/google/uuid"
 
 	"github.com/aminpaks/go-streams/pkg/async"
@@ -34,10 +36,20 @@ func NewUserController(depsCtx context.Context, shutdown context.Context, syncGr
 	r.Get("/", h.New(controller.HandleList))
 	r.Get("/{userId}", h.New(controller.HandleGet))
 
-	err = xredis.RegisterStreamConsumer(depsCtx, "usersTest", "registerUsers", userCreationConsumer(), xredis.NewStreamConsumerOptions(2, 3))
+	streamOptions := xredis.NewStreamConsumerOptions(2, 3)
+	// Entries stay pending until the user is created, so a crash won't lose them
+	streamOptions.AtLeastOnce = true
+	streamOptions.RetryBackoff = xredis.ExponentialJitterBackoff(time.Second*5, time.Minute)
+	// Entries left behind by crashed instances are picked up after a minute
+	streamOptions.ReclaimMinIdle = time.Minute
+	streamOptions.DeadConsumerIdle = time.Hour
+	// Processed users are kept for a day
+	streamOptions.Retention = &xredis.StreamRetention{MaxAge: time.Hour * 24, Approx: true}
+	usersStreamDone, err := xredis.RegisterStreamConsumer(depsCtx, shutdown, "usersTest", "registerUsers", userCreationConsumer(), streamOptions)
 	if err != nil {
 		return fmt.Errorf("RegisterConsumer: %v", err)
 	}
+	syncGroup.AddChannel("users stream consumer", usersStreamDone)
 
 	redisClient, err := xredis.GetClient(depsCtx)
 	if err != nil {
@@ -56,9 +68,10 @@ func NewUserController(depsCtx context.Context, shutdown context.Context, syncGr
 			testQueueEntryConsumer(worker),
 			testQueueFailureHandler(),
 			&xredis.XSortedQueueOptions{
-				MaxRetries: 3,
-				Consuming:  2,
-				Consumers:  2,
+				MaxRetries:          3,
+				Consuming:           2,
+				Consumers:           2,
+				DeadLetterRetention: time.Hour * 24,
 			},
 		),
 	)
@@ -121,7 +134,16 @@ func (us *UserController) HandleCreate(rw http.ResponseWriter, r *http.Request)
 		return re.Json(http.StatusBadRequest, re.JsonErrors(merrors.ErrorsOrElse(err)...))
 	}
 
-	ref, err := xredis.StreamAppend(us.depsCtx, "usersTest", user.WithId(uuid.New()).String())
+	headers := map[string]string{
+		xredis.HeaderProducer:      "users",
+		xredis.HeaderSchemaVersion: "1",
+	}
+	if requestId := middleware.GetReqID(r.Context()); requestId != "" {
+		headers[xredis.HeaderCorrelationId] = requestId
+	}
+	ref, err := xredis.StreamAppendValue(us.depsCtx, "usersTest", xredis.JSONCodec, user.WithId(uuid.New()), &xredis.StreamAppendOptions{
+		Headers: headers,
+	})
 	if err != nil {
 		log.Printf("failed to append entry to stream: %v", err)
 		return re.Json(http.StatusInternalServerError, re.JsonErrors(re.ToJsonError("Failed to process request")))
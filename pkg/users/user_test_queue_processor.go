@@ -1,6 +1,7 @@
 package users
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
@@ -12,7 +13,7 @@ import (
 func testQueueEntryConsumer(worker *throttler.Throttler) xredis.XSortedQueueEntryConsumerFunc {
 	rand.Seed(rand.Int63())
 
-	return func(entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+	return func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
 		log.Printf("batch length: %d -- %s", len(entries), consumerId)
 
 		for i := range entries {
@@ -61,16 +62,11 @@ func testQueueFailureHandler() xredis.XSortedQueueFailureHandlerFunc {
 			// Just notify for the sake of the demo
 			log.Printf("-- %s :: handling failure -- %v --> (%v)", consumerId, f.Err, f.Payload.String())
 
-			// Payload of failure can include the entry too, in that case we will handle
-			// the entry manually or wanna correct its state and queue it for retry.
-			// IMPORTANT NOTE: We must always clean the failed entries as they will NOT
-			//                 be cleaned up automatically by the queue.
-			switch e := f.Payload["entry"].(type) {
-			case xredis.XSortedQueueEntry:
-				// Attempt to clean up the resource
-				if err := e.CleanUp(); err != nil {
-					log.Printf("Failed to clean up: %v", err)
-				}
+			// Payload of failure can include the entry too. Entries that have exhausted
+			// their retries are already moved to the dead letters of the queue, they can
+			// be inspected and requeued with xredis.RequeueSortedQueueDeadLetter.
+			if e, ok := f.Payload["entry"].(xredis.XSortedQueueEntry); ok {
+				log.Printf("-- %s :: entry %s failed %d times: %v", consumerId, e.ReferenceUri, len(e.Failures), e.Failures)
 			}
 		}
 	}
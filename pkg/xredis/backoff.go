@@ -0,0 +1,83 @@
+package xredis
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff decides how long to wait before retrying an entry,
+// retry is the amount of the attempts that have failed so far
+type Backoff interface {
+	Delay(retry int) time.Duration
+}
+
+// BackoffFunc lets an ordinary function be used as a Backoff
+type BackoffFunc func(retry int) time.Duration
+
+func (f BackoffFunc) Delay(retry int) time.Duration {
+	return f(retry)
+}
+
+// FixedBackoff waits the same delay before every retry
+func FixedBackoff(delay time.Duration) Backoff {
+	return BackoffFunc(func(retry int) time.Duration {
+		return delay
+	})
+}
+
+// LinearBackoff grows the delay by step on every retry, up to max
+func LinearBackoff(step time.Duration, max time.Duration) Backoff {
+	return BackoffFunc(func(retry int) time.Duration {
+		if retry < 1 {
+			retry = 1
+		}
+		// Stops growing once we reach the max or before overflowing
+		if step > 0 && time.Duration(retry) > math.MaxInt64/step {
+			return max
+		}
+		delay := step * time.Duration(retry)
+		if max > 0 && delay > max {
+			return max
+		}
+		return delay
+	})
+}
+
+// ExponentialBackoff doubles the delay on every retry starting from base, up to max
+func ExponentialBackoff(base time.Duration, max time.Duration) Backoff {
+	return BackoffFunc(func(retry int) time.Duration {
+		return exponentialDelay(base, max, retry)
+	})
+}
+
+// ExponentialJitterBackoff works like ExponentialBackoff but randomizes the second half
+// of each delay, so entries failed together don't all come back at the same time
+func ExponentialJitterBackoff(base time.Duration, max time.Duration) Backoff {
+	return BackoffFunc(func(retry int) time.Duration {
+		delay := exponentialDelay(base, max, retry)
+		if delay < 2 {
+			return delay
+		}
+		half := delay / 2
+		return half + time.Duration(rand.Int63n(int64(half)))
+	})
+}
+
+func exponentialDelay(base time.Duration, max time.Duration, retry int) time.Duration {
+	if retry < 1 {
+		retry = 1
+	}
+	delay := base
+	for i := 1; i < retry; i++ {
+		// Stops doubling once we reach the max or before overflowing
+		if (max > 0 && delay >= max) || delay > math.MaxInt64/2 {
+			break
+		}
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		return max
+	}
+	return delay
+}
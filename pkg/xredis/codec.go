@@ -0,0 +1,107 @@
+package xredis
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var ErrEncode = errors.New("failed to encode")
+var ErrDecode = errors.New("failed to decode")
+
+// Codec encodes and decodes the payloads of the queues and streams
+type Codec interface {
+	// ContentType is attached to the stream entries as HeaderContentType
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// textCodec is implemented by the codecs that always produce valid UTF-8 text,
+// their payloads are stored as is instead of being base64 encoded
+type textCodec interface {
+	isText() bool
+}
+
+var (
+	JSONCodec        Codec = jsonCodec{}
+	MessagePackCodec Codec = messagePackCodec{}
+	GobCodec         Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+func (jsonCodec) isText() bool {
+	return true
+}
+
+type messagePackCodec struct{}
+
+func (messagePackCodec) ContentType() string {
+	return "application/msgpack"
+}
+func (messagePackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+func (messagePackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string {
+	return "application/x-gob"
+}
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// EncodeValue encodes v into a payload value. Payloads are persisted as part of JSON
+// documents, therefore the output of binary codecs is base64 encoded.
+func EncodeValue(codec Codec, v interface{}) (string, error) {
+	b, err := codec.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrEncode, err)
+	}
+	if c, ok := codec.(textCodec); ok && c.isText() {
+		return string(b), nil
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// DecodeValue decodes a payload value encoded by EncodeValue into v
+func DecodeValue(codec Codec, value string, v interface{}) error {
+	b := []byte(value)
+	if c, ok := codec.(textCodec); !ok || !c.isText() {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrDecode, err)
+		}
+		b = decoded
+	}
+	if err := codec.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package xredis_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aminpaks/go-streams/pkg/testrun"
+	"github.com/aminpaks/go-streams/pkg/xredis"
+)
+
+type codecTestValue struct {
+	Name  string
+	Count int
+}
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	r := testrun.New(t)
+
+	r.Run(
+		r.It("Should encode and decode the values with every codec", func(t *testing.T) {
+			assert := assert.New(t)
+
+			for _, codec := range []xredis.Codec{xredis.JSONCodec, xredis.MessagePackCodec, xredis.GobCodec} {
+				encoded, err := xredis.EncodeValue(codec, codecTestValue{Name: "name", Count: 3})
+				assert.Nil(err, codec.ContentType())
+
+				var decoded codecTestValue
+				assert.Nil(xredis.DecodeValue(codec, encoded, &decoded), codec.ContentType())
+				assert.Equal(codecTestValue{Name: "name", Count: 3}, decoded, codec.ContentType())
+			}
+		}),
+
+		r.It("Should return a decode error for invalid values", func(t *testing.T) {
+			assert := assert.New(t)
+
+			var decoded codecTestValue
+			assert.ErrorIs(xredis.DecodeValue(xredis.JSONCodec, "{invalid", &decoded), xredis.ErrDecode)
+			assert.ErrorIs(xredis.DecodeValue(xredis.GobCodec, "not base64!", &decoded), xredis.ErrDecode)
+		}),
+
+		r.It("Should move the stream entries that cannot be decoded to the dead-letter stream", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, _ := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			processed := make(chan *codecTestValue, 1)
+			_, err := xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "group", xredis.NewStreamValueConsumer(
+				xredis.MessagePackCodec,
+				func() interface{} { return &codecTestValue{} },
+				func(value interface{}, entry xredis.XStreamEntry, consumerId string) error {
+					processed <- value.(*codecTestValue)
+					return nil
+				},
+			), xredis.NewStreamConsumerOptions(1, 5))
+			assert.Nil(err)
+
+			_, err = xredis.StreamAppendValue(depsCtx, "stream", xredis.MessagePackCodec, codecTestValue{Name: "valid"}, nil)
+			assert.Nil(err)
+			_, err = xredis.StreamAppendValue(depsCtx, "stream", xredis.JSONCodec, codecTestValue{Name: "invalid"}, nil)
+			assert.Nil(err)
+
+			select {
+			case value := <-processed:
+				assert.Equal("valid", value.Name)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+
+			var deadLetters []xredis.XStreamDeadLetter
+			assert.Eventually(func() bool {
+				deadLetters, err = xredis.ListStreamDeadLetters(depsCtx, xredis.DeadLetterStreamName("stream"), 10)
+				return err == nil && len(deadLetters) == 1
+			}, time.Second*5, time.Millisecond*10)
+			assert.Equal(1, deadLetters[0].Entry.Retries)
+			assert.Equal("application/json", deadLetters[0].Entry.Header(xredis.HeaderContentType))
+		}),
+	)
+}
@@ -0,0 +1,31 @@
+package xredis
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aminpaks/go-streams/pkg/env"
+)
+
+// ConsumerId returns a stable id for the consumer made of the prefix, the name of the
+// running instance and the index of the consumer. A restarted instance gets the same
+// ids back, which lets it resume the work left behind by its previous run.
+func ConsumerId(prefix string, index int) string {
+	return fmt.Sprintf("%s-%s-%d", prefix, InstanceName(), index)
+}
+
+// InstanceName returns the name of the running instance, POD_NAME takes precedence
+// over HOSTNAME and the host name reported by the kernel. Instances must not share
+// the same name, otherwise their consumers will share their ids too.
+func InstanceName() string {
+	if name := env.Get("POD_NAME", ""); name != "" {
+		return name
+	}
+	if name := env.Get("HOSTNAME", ""); name != "" {
+		return name
+	}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,70 @@
+package xredis_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aminpaks/go-streams/pkg/testrun"
+	"github.com/aminpaks/go-streams/pkg/xredis"
+)
+
+// TestConsumerId changes the environment, therefore it must not run in parallel
+func TestConsumerId(t *testing.T) {
+	r := testrun.New(t)
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "unknown"
+	}
+
+	r.Run(
+		r.It("Should name the instance by POD_NAME, HOSTNAME and then the host name", func(t *testing.T) {
+			assert := assert.New(t)
+
+			for _, tc := range []struct {
+				podName  *string
+				hostname *string
+				instance string
+			}{
+				{podName: stringPtr("pod-1"), hostname: stringPtr("host-1"), instance: "pod-1"},
+				{podName: stringPtr("pod-1"), hostname: nil, instance: "pod-1"},
+				{podName: stringPtr(""), hostname: stringPtr("host-1"), instance: "host-1"},
+				{podName: nil, hostname: stringPtr("host-1"), instance: "host-1"},
+				{podName: nil, hostname: stringPtr(""), instance: hostname},
+				{podName: nil, hostname: nil, instance: hostname},
+			} {
+				restorePodName := setTestEnv("POD_NAME", tc.podName)
+				restoreHostname := setTestEnv("HOSTNAME", tc.hostname)
+
+				assert.Equal(tc.instance, xredis.InstanceName())
+				assert.Equal("group-"+tc.instance+"-3", xredis.ConsumerId("group", 3))
+
+				restoreHostname()
+				restorePodName()
+			}
+		}),
+	)
+}
+
+// setTestEnv sets the variable or unsets it if value is nil, it returns a func restoring it
+func setTestEnv(key string, value *string) func() {
+	previous, ok := os.LookupEnv(key)
+	if value == nil {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, *value)
+	}
+	return func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -8,3 +8,54 @@ func sortedQueueProcessingReferenceKey(queue string) string {
 func sortedQueueProcessingPriorityKey(queue string) string {
 	return fmt.Sprintf("sortedQueue::%s::processing::priory", queue)
 }
+func sortedQueueProcessingLeasesKey(queue string) string {
+	return fmt.Sprintf("sortedQueue::%s::processing::leases", queue)
+}
+func sortedQueueProcessingTokensKey(queue string) string {
+	return fmt.Sprintf("sortedQueue::%s::processing::tokens", queue)
+}
+
+func sortedQueueReapsKey(queue string) string {
+	return fmt.Sprintf("sortedQueue::%s::reaps", queue)
+}
+func sortedQueueNotifyKey(queue string) string {
+	return fmt.Sprintf("sortedQueue::%s::notify", queue)
+}
+func sortedQueuePausedKey(queue string) string {
+	return fmt.Sprintf("sortedQueue::%s::paused", queue)
+}
+func sortedQueueScheduledReferenceKey(queue string) string {
+	return fmt.Sprintf("sortedQueue::%s::scheduled::reference", queue)
+}
+func sortedQueueScheduledPriorityKey(queue string) string {
+	return fmt.Sprintf("sortedQueue::%s::scheduled::priority", queue)
+}
+func sortedQueueDeadReferenceKey(queue string) string {
+	return fmt.Sprintf("sortedQueue::%s::dead::reference", queue)
+}
+func sortedQueueDeadPayloadKey(queue string) string {
+	return fmt.Sprintf("sortedQueue::%s::dead::payload", queue)
+}
+
+func streamErrorsKey(stream string, group string) string {
+	return fmt.Sprintf("stream::%s::%s::errors", stream, group)
+}
+func streamDelayedKey(stream string) string {
+	return fmt.Sprintf("stream::%s::delayed", stream)
+}
+
+func queueProcessingKey(queue string, consumerId string) string {
+	return fmt.Sprintf("queue::%s::processing::%s", queue, consumerId)
+}
+func queueConsumersKey(queue string) string {
+	return fmt.Sprintf("queue::%s::consumers", queue)
+}
+func queueFailedKey(queue string) string {
+	return fmt.Sprintf("queue::%s::failed", queue)
+}
+func queueStatusKey(referenceUri string) string {
+	return fmt.Sprintf("queue::status::%s", referenceUri)
+}
+func queueIdempotencyKey(queue string, key string) string {
+	return fmt.Sprintf("queue::%s::idempotency::%s", queue, key)
+}
@@ -2,154 +2,514 @@ package xredis
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 )
 
 var ctx = context.Background()
 
-type XQueuer func(queueName string, entries ...XQueueEntry) (referenceUris []string, errs map[string]error)
+// queueEntryExpiration is how long the payloads of the entries are kept by default
+const queueEntryExpiration = time.Hour * 24
 
-func NewQueueConsumer(depsCtx context.Context, queueName string, count int, consumerFn func(val ...XQueueEntry)) error {
+// queueHeartbeatInterval is how often the consumers report they're alive
+const queueHeartbeatInterval = time.Second * 5
+
+// queueConsumerTimeout is how long a consumer may miss its heartbeats before
+// its processing entries are queued again
+const queueConsumerTimeout = time.Second * 30
+
+// queueRecoveryInterval is how often the processing entries of the dead consumers are recovered
+const queueRecoveryInterval = time.Second * 15
+
+// XQueuer enqueues the entries to the queue, the results are in the order of the entries
+// and the errors are keyed by their reference URIs
+type XQueuer func(queueName string, entries ...XQueueEntry) (results []XQueueEnqueueResult, errs map[string]error)
+
+// XQueueConsumerFunc processes a batch of entries and returns the error of each entry at the
+// same index, nil or missing errors mean the entry is done. Failed entries are queued again
+// until they exhaust their retries.
+type XQueueConsumerFunc func(entries ...XQueueEntry) []error
+type XQueueFailureHandlerFunc func(failures []XFailure, consumerId string)
+
+// NewQueueConsumer runs the consumers of the queue until shutdown, the returned channel is closed
+// once they've finished their batches. The entries are moved to the processing list of their
+// consumer when they're popped and acked once consumerFn returns, unless consumerFn has acked
+// them already. If a consumer dies in between its entries are queued again, by the other
+// consumers once it misses its heartbeats or by itself when it's restarted.
+func NewQueueConsumer(
+	depsCtx context.Context,
+	shutdown context.Context,
+	queueName string,
+	consumerFn XQueueConsumerFunc,
+	failureHandler XQueueFailureHandlerFunc,
+	options *XQueueConsumerOptions,
+) (chan struct{}, error) {
 	rdb, err := GetClient(depsCtx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if count < 1 {
-		count = 1
+	if options == nil {
+		options = NewXQueueConsumerOptions()
 	}
+	options.Normalize() // Removes invalid options
+
 	if queueName == "" {
 		queueName = "randomQueueName" + strconv.Itoa(rand.Int())
 	}
+	if options.ConsumerPrefix == "" {
+		options.ConsumerPrefix = queueName
+	}
+	if failureHandler == nil {
+		failureHandler = logQueueFailures
+	}
+
+	consumerIds := []string{}
+	for i := 1; i <= options.Consumers; i++ {
+		consumerId := ConsumerId(options.ConsumerPrefix, i)
+		// The entries left behind by the previous run of the consumer are queued again
+		// before it reports it's alive, otherwise they would wait for it forever
+		if _, err := recoverQueueEntries(rdb, queueName, consumerId, time.Now()); err != nil {
+			return nil, fmt.Errorf("failed to recover queue %s: %v", queueName, err)
+		}
+		consumerIds = append(consumerIds, consumerId)
+	}
+	if err := queueHeartbeat(rdb, queueName, consumerIds...); err != nil {
+		return nil, fmt.Errorf("failed to register consumers of queue %s: %v", queueName, err)
+	}
 
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
 	go func() {
-		for {
-			values := []XQueueEntry{}
-			for i := 0; i < count; i++ {
-				entry, err := internalPopFromTop(rdb, queueName)
-				if err != nil {
-					log.Printf("queue %s: %v", queueName, err)
-				}
-				if entry != nil {
-					values = append(values, *entry)
+		defer wg.Done()
+		runQueueHeartbeat(rdb, shutdown, queueName, consumerIds)
+	}()
+	for _, consumerId := range consumerIds {
+		consumerId := consumerId
+		popper := newQueuePopper(rdb, queueName, consumerId)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Printf("running queue consumer %s", consumerId)
+			for {
+				select {
+				case <-shutdown.Done():
+					log.Printf("queue consumer %s is done", consumerId)
+					return
+				default:
+					internalConsumeQueue(consumerId, popper, consumerFn, failureHandler, *options)
 				}
 			}
-			if len(values) > 0 {
-				consumerFn(values...)
+		}()
+	}
+	// This go routine will make sure we close the channel once all the consumers
+	// safely completed their work on shuting down
+	go func() {
+		wg.Wait()
+		// The processing lists are empty, there's nothing to recover
+		if err := rdb.ZRem(ctx, queueConsumersKey(queueName), strToInterface(consumerIds...)...).Err(); err != nil {
+			log.Printf("queue %s: failed to unregister consumers: %v", queueName, err)
+		}
+		close(done)
+	}()
+
+	return done, nil
+}
+
+func internalConsumeQueue(
+	consumerId string,
+	popper *queuePopper,
+	consumerFn XQueueConsumerFunc,
+	failureHandler XQueueFailureHandlerFunc,
+	options XQueueConsumerOptions,
+) {
+	entries := []XQueueEntry{}
+	for i := 0; i < options.Consuming; i++ {
+		// Only waits for the first entry of the batch
+		entry, err := popper.pop(i == 0)
+		if err != nil {
+			failureHandler([]XFailure{{Err: fmt.Errorf("failed to read queue: %v", err)}}, consumerId)
+			// Slows down on internal errors instead of looping on the same failure
+			time.Sleep(time.Second)
+			break
+		}
+		if entry == nil {
+			break
+		}
+		entries = append(entries, *entry)
+	}
+	if len(entries) == 0 {
+		return
+	}
+	if failures := handleXQueueEntries(consumerFn, entries, options); len(failures) > 0 {
+		failureHandler(failures, consumerId)
+	}
+}
+
+func handleXQueueEntries(consumerFn XQueueConsumerFunc, entries []XQueueEntry, options XQueueConsumerOptions) (failures []XFailure) {
+	errs := callQueueConsumer(consumerFn, entries)
+	for i, entry := range entries {
+		var failure error
+		if i < len(errs) {
+			failure = errs[i]
+		}
+		if failure == nil {
+			if err := entry.Ack(); err != nil {
+				failures = append(failures, XFailure{Err: fmt.Errorf("failed to ack: %v", err), Payload: XGenericMap{"entry": entry}})
+			}
+			continue
+		}
+		if err := retryQueueEntry(entry, failure, options); err != nil {
+			failures = append(failures, XFailure{Err: err, Payload: XGenericMap{"entry": entry}})
+		}
+	}
+	return failures
+}
+
+// callQueueConsumer turns a panic of the consumer into a failure of all the entries
+func callQueueConsumer(consumerFn XQueueConsumerFunc, entries []XQueueEntry) (errs []error) {
+	defer func() {
+		if r := recover(); r != nil {
+			errs = make([]error, len(entries))
+			for i := range errs {
+				errs[i] = fmt.Errorf("PANIC: %v", r)
 			}
 		}
 	}()
+	return consumerFn(entries...)
+}
 
+// retryQueueEntry queues the failed entry again, or moves it to the failed entries of the queue
+// once it has exhausted its retries. It returns an error if the entry couldn't be retried.
+func retryQueueEntry(entry XQueueEntry, failure error, options XQueueConsumerOptions) error {
+	entry.Failures = append(entry.Failures, failure.Error())
+	if entry.Retries >= options.MaxRetries {
+		if err := failQueueEntry(entry); err != nil {
+			return fmt.Errorf("retries exhausted: %v: %v", failure, err)
+		}
+		return fmt.Errorf("retries exhausted: %v", failure)
+	}
+	entry.Retries++
+
+	err := retryQueueEntryScript.Run(
+		ctx,
+		entry.c,
+		[]string{entry.processing, entry.queue, entry.ReferenceUri, queueStatusKey(entry.ReferenceUri)},
+		entry.String(),
+		durationToMilliseconds(queueEntryExpiration),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to retry: %v", err)
+	}
 	return nil
 }
 
-func GetQueueValue(referenceUri string) (string, error) {
-	return "", nil
+// failQueueEntry moves the entry from processing to the failed entries of its queue
+func failQueueEntry(entry XQueueEntry) error {
+	return failQueueEntryScript.Run(
+		ctx,
+		entry.c,
+		[]string{entry.processing, queueFailedKey(entry.queue), entry.ReferenceUri, queueStatusKey(entry.ReferenceUri)},
+		entry.String(),
+		unixMilliseconds(time.Now()),
+	).Err()
+}
+
+// ListFailedQueueEntries returns up to count entries of the queue that have exhausted their retries, oldest first
+func ListFailedQueueEntries(client *RedisClient, ctx context.Context, queueName string, count int64) ([]XQueueEntry, error) {
+	values, err := client.LRange(ctx, queueFailedKey(queueName), 0, count-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := []XQueueEntry{}
+	for _, value := range values {
+		entry, err := parseQueueEntry(value)
+		if err != nil {
+			log.Printf("failed to decode failed entry of queue %s: %v", queueName, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func logQueueFailures(failures []XFailure, consumerId string) {
+	for _, f := range failures {
+		log.Printf("queue consumer %s: %v %v", consumerId, f.Err, f.Payload)
+	}
+}
+
+// XQueueEnqueueResult is the outcome of enqueuing an entry
+type XQueueEnqueueResult struct {
+	// ReferenceUri is the reference of the entry, or the reference of the entry
+	// enqueued before with the same idempotency key if it's been deduplicated
+	ReferenceUri string
+	// Deduplicated is true if the entry has been skipped since an entry with the same
+	// reference is queued or processing, or one with the same idempotency key has been
+	// enqueued within the deduplication window
+	Deduplicated bool
 }
 
+// BuildQueuer returns a queuer that enqueues the entries of each call at once with
+// the default options, either all of them are enqueued or none
 func BuildQueuer(depsCtx context.Context) (XQueuer, error) {
+	return BuildQueuerWithOptions(depsCtx, nil)
+}
+
+// BuildQueuerWithOptions works like BuildQueuer with the given options, queues
+// with different options need a queuer each
+func BuildQueuerWithOptions(depsCtx context.Context, options *XQueuerOptions) (XQueuer, error) {
 	rdb, err := GetClient(depsCtx)
 	if err != nil {
 		return nil, err
 	}
+	if options == nil {
+		options = NewXQueuerOptions()
+	}
+	options.Normalize() // Removes invalid options
 
-	return func(queueName string, entries ...XQueueEntry) (referenceUris []string, errs map[string]error) {
+	return func(queueName string, entries ...XQueueEntry) (results []XQueueEnqueueResult, errs map[string]error) {
 		errs = make(map[string]error)
-		referenceUris = make([]string, 0)
 
-		for _, entry := range entries {
-			referenceUri, err := enqueueEntry(rdb, queueName, entry)
-			if err != nil {
-				errs[referenceUri] = err
+		results, err := EnqueueQueueEntriesWithOptions(rdb, ctx, queueName, options, entries...)
+		if err != nil {
+			// The batch fails before any of the entries is enqueued
+			for _, result := range results {
+				errs[result.ReferenceUri] = err
 			}
-			referenceUris = append(referenceUris, referenceUri)
 		}
 
-		return referenceUris, errs
+		return results, errs
 	}, nil
 }
 
-func enqueueEntry(rdb *RedisClient, queueName string, entry XQueueEntry) (referenceUri string, err error) {
-	if entry.ReferenceUri == "" {
-		entry.ReferenceUri = fmt.Sprintf("gid://%s/%s", queueName, uuid.New().String())
-	}
-	referenceUri = entry.ReferenceUri
+// EnqueueQueueEntries enqueues the entries with the default options, see EnqueueQueueEntriesWithOptions
+func EnqueueQueueEntries(client *RedisClient, ctx context.Context, queueName string, entries ...XQueueEntry) ([]XQueueEnqueueResult, error) {
+	return EnqueueQueueEntriesWithOptions(client, ctx, queueName, nil, entries...)
+}
 
-	exist, err := rdb.Exists(ctx, referenceUri).Result()
-	if err != nil && err != redis.Nil {
-		return referenceUri, err
+// EnqueueQueueEntriesWithOptions enqueues the entries in a single step, a queue that isn't a list
+// fails the batch before any of them is enqueued. Entries without a reference get a new one, the
+// results are in the order of the entries and hold their references even if enqueuing fails.
+func EnqueueQueueEntriesWithOptions(client *RedisClient, ctx context.Context, queueName string, options *XQueuerOptions, entries ...XQueueEntry) ([]XQueueEnqueueResult, error) {
+	if options == nil {
+		options = NewXQueuerOptions()
 	}
-	if exist == 1 {
-		return referenceUri, nil
+	options.Normalize()
+
+	results := []XQueueEnqueueResult{}
+	if len(entries) == 0 {
+		return results, nil
 	}
 
-	release := lock(rdb, referenceUri)
-	defer func() {
-		if err := release(); err != nil {
-			log.Print(err)
+	keys := []string{queueName}
+	args := []interface{}{
+		durationToMilliseconds(options.TTL),
+		unixMilliseconds(time.Now()),
+		durationToMilliseconds(options.DedupWindow),
+	}
+	for _, entry := range entries {
+		if entry.ReferenceUri == "" {
+			entry.ReferenceUri = fmt.Sprintf("gid://%s/%s", queueName, uuid.New().String())
 		}
-	}()
-
-	err = rdb.Set(ctx, referenceUri, entry.String(), time.Hour*24).Err()
-	if err != nil {
-		return referenceUri, err
+		idempotencyKey := ""
+		if entry.IdempotencyKey != "" {
+			idempotencyKey = queueIdempotencyKey(queueName, entry.IdempotencyKey)
+		}
+		results = append(results, XQueueEnqueueResult{ReferenceUri: entry.ReferenceUri})
+		keys = append(keys, entry.ReferenceUri, queueStatusKey(entry.ReferenceUri), idempotencyKey)
+		args = append(args, entry.String())
 	}
 
-	err = rdb.RPush(ctx, queueName, referenceUri).Err()
+	enqueued, err := enqueueQueueEntriesScript.Run(ctx, client, keys, args...).Slice()
 	if err != nil {
-		return referenceUri, err
+		return results, err
 	}
+	for i, v := range enqueued {
+		switch v := v.(type) {
+		case int64:
+			results[i].Deduplicated = v == 0
+		case string:
+			// Deduplicated by the idempotency key
+			results[i].ReferenceUri = v
+			results[i].Deduplicated = true
+		}
+	}
+	return results, nil
+}
+
+// errInvalidQueueEntry is returned when reading an entry that will never succeed
+var errInvalidQueueEntry = errors.New("invalid queue entry")
 
-	return referenceUri, nil
+// queuePopper moves the references of a queue to the processing list of its consumer
+type queuePopper struct {
+	rdb        *RedisClient
+	queue      string
+	processing string
+	// unsupported is true if the server doesn't support BLMOVE
+	unsupported bool
 }
 
-func internalPopFromTop(rdb *RedisClient, queueName string) (*XQueueEntry, error) {
-	ctx := context.Background()
+func newQueuePopper(rdb *RedisClient, queue string, consumerId string) *queuePopper {
+	return &queuePopper{rdb: rdb, queue: queue, processing: queueProcessingKey(queue, consumerId)}
+}
 
-	cmd := rdb.BLPop(ctx, time.Second, queueName)
-	v, err := cmd.Result()
+// pop moves the oldest reference of the queue to the processing list and returns its entry,
+// it waits up to a second for a reference if block is true. The entry is nil if the queue is
+// empty or the entry is invalid, invalid entries are dropped since they'll never succeed.
+// The reference is pushed back to the queue if its entry can't be read for any other reason.
+func (p *queuePopper) pop(block bool) (*XQueueEntry, error) {
+	referenceUri, err := p.move(block)
 	if err != nil {
-		if err.Error() == "redis: nil" {
+		if err == redis.Nil {
 			return nil, nil
 		}
 		return nil, err
 	}
-	if len(v) < 2 {
-		return nil, fmt.Errorf("invalid entry: %v", v)
+
+	entry, err := p.read(referenceUri)
+	if err != nil {
+		if errors.Is(err, errInvalidQueueEntry) {
+			log.Printf("queue %s: dropping %s: %v", p.queue, referenceUri, err)
+			return nil, ackQueueEntry(p.rdb, p.processing, referenceUri)
+		}
+		// The reference stays in the processing list and is recovered
+		// once the consumer restarts if it can't be pushed back either
+		if _, pushErr := p.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.LRem(ctx, p.processing, 1, referenceUri)
+			pipe.RPush(ctx, p.queue, referenceUri)
+			return nil
+		}); pushErr != nil {
+			log.Printf("queue %s: failed to push %s back: %v", p.queue, referenceUri, pushErr)
+		}
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (p *queuePopper) move(block bool) (string, error) {
+	if !block {
+		return p.rdb.RPopLPush(ctx, p.queue, p.processing).Result()
 	}
-	referenceUri := v[1]
-	release := lock(rdb, referenceUri)
-	defer func() {
-		if err := release(); err != nil {
-			log.Print(err)
+	if !p.unsupported {
+		referenceUri, err := p.rdb.BLMove(ctx, p.queue, p.processing, "RIGHT", "LEFT", time.Second).Result()
+		if err == nil || !isUnknownCommandError(err) {
+			return referenceUri, err
 		}
-	}()
+		// BLMOVE is supported since Redis 6.2
+		p.unsupported = true
+		log.Printf("BLMOVE is not supported, queue %s falls back to BRPOPLPUSH: %v", p.queue, err)
+	}
+	return p.rdb.BRPopLPush(ctx, p.queue, p.processing, time.Second).Result()
+}
 
+func (p *queuePopper) read(referenceUri string) (*XQueueEntry, error) {
 	if !strings.HasPrefix(referenceUri, "gid://") {
-		return nil, fmt.Errorf("invalid queue entry - should start with 'gid://': %v", v)
+		return nil, fmt.Errorf("%w - should start with 'gid://': %v", errInvalidQueueEntry, referenceUri)
 	}
 
-	serializedEntry, err := rdb.Get(ctx, referenceUri).Result()
+	serializedEntry, err := p.rdb.Get(ctx, referenceUri).Result()
 	if err != nil {
+		if err == redis.Nil {
+			return nil, fmt.Errorf("%w - '%v' has expired or been removed", errInvalidQueueEntry, referenceUri)
+		}
 		return nil, fmt.Errorf("failed to get queue entry '%v': %v", referenceUri, err)
 	}
 
 	entry, err := parseQueueEntry(serializedEntry)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse queue entry: %v -> '%v'", err, serializedEntry)
+		return nil, fmt.Errorf("%w - failed to parse: %v -> '%v'", errInvalidQueueEntry, err, serializedEntry)
 	}
+	entry.c = p.rdb
+	entry.queue = p.queue
+	entry.processing = p.processing
 
-	if err = rdb.Del(ctx, referenceUri).Err(); err != nil {
-		return nil, fmt.Errorf("failed to clean up queue entry: %v -> '%v'", err, serializedEntry)
+	if err := startQueueEntry(p.rdb, entry); err != nil {
+		// The status is informational, the entry is processed anyway
+		log.Printf("queue %s: failed to update the status of %s: %v", p.queue, referenceUri, err)
 	}
 
 	return &entry, nil
 }
+
+// ackQueueEntry removes the reference from the processing list and its payload,
+// the payload is kept if the reference isn't processing anymore
+func ackQueueEntry(rdb *RedisClient, processing string, referenceUri string) error {
+	return ackQueueEntryScript.Run(ctx, rdb, []string{processing, referenceUri, queueStatusKey(referenceUri)}, unixMilliseconds(time.Now())).Err()
+}
+
+func queueHeartbeat(rdb *RedisClient, queue string, consumerIds ...string) error {
+	now := float64(unixMilliseconds(time.Now()))
+	heartbeats := []*redis.Z{}
+	for _, consumerId := range consumerIds {
+		heartbeats = append(heartbeats, &redis.Z{Score: now, Member: consumerId})
+	}
+	return rdb.ZAdd(ctx, queueConsumersKey(queue), heartbeats...).Err()
+}
+
+// runQueueHeartbeat reports the consumers are alive and periodically recovers
+// the processing entries of the dead consumers until shutdown
+func runQueueHeartbeat(rdb *RedisClient, shutdown context.Context, queue string, consumerIds []string) {
+	var recoveredAt time.Time
+	for {
+		if err := queueHeartbeat(rdb, queue, consumerIds...); err != nil {
+			log.Printf("queue %s: failed to send heartbeats: %v", queue, err)
+		}
+		if time.Since(recoveredAt) >= queueRecoveryInterval {
+			if err := recoverDeadQueueConsumers(rdb, queue); err != nil {
+				log.Printf("queue %s: failed to recover dead consumers: %v", queue, err)
+			}
+			recoveredAt = time.Now()
+		}
+		select {
+		case <-shutdown.Done():
+			return
+		case <-time.After(queueHeartbeatInterval):
+		}
+	}
+}
+
+// recoverDeadQueueConsumers queues the processing entries of the consumers
+// that have missed their heartbeats again
+func recoverDeadQueueConsumers(rdb *RedisClient, queue string) error {
+	cutoff := time.Now().Add(-queueConsumerTimeout)
+	consumerIds, err := rdb.ZRangeByScore(ctx, queueConsumersKey(queue), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(unixMilliseconds(cutoff), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, consumerId := range consumerIds {
+		recovered, err := recoverQueueEntries(rdb, queue, consumerId, cutoff)
+		if err != nil {
+			return err
+		}
+		if recovered > 0 {
+			log.Printf("queue %s: recovered %d entries of dead consumer %s", queue, recovered, consumerId)
+		}
+	}
+	return nil
+}
+
+// recoverQueueEntries queues the processing entries of the consumer again if it hasn't
+// sent a heartbeat since the cutoff, it returns -1 if the consumer is alive
+func recoverQueueEntries(rdb *RedisClient, queue string, consumerId string, cutoff time.Time) (int, error) {
+	return recoverQueueEntriesScript.Run(
+		ctx,
+		rdb,
+		[]string{queue, queueConsumersKey(queue), queueProcessingKey(queue, consumerId)},
+		consumerId,
+		unixMilliseconds(cutoff),
+		queueStatusKey(""),
+	).Int()
+}
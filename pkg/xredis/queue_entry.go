@@ -6,8 +6,18 @@ import (
 )
 
 type XQueueEntry struct {
-	ReferenceUri string `json:"referenceUri"`
-	Value        string `json:"value"`
+	// Internal use only
+	c          *RedisClient `json:"-"`
+	queue      string       `json:"-"`
+	processing string       `json:"-"`
+
+	ReferenceUri string   `json:"referenceUri"`
+	Value        string   `json:"value"`
+	Retries      int      `json:"retries,omitempty"`
+	Failures     []string `json:"failures,omitempty"`
+	// IdempotencyKey deduplicates the entries enqueued with the same key within
+	// the deduplication window, regardless of their reference
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 func NewXQueueEntry(value string) XQueueEntry {
@@ -20,6 +30,28 @@ func NewXQueueEntryByReference(value string, referenceUri string) XQueueEntry {
 	}
 }
 
+// NewXQueueEntryWithValue encodes the value with the codec into a new entry
+func NewXQueueEntryWithValue(codec Codec, value interface{}) (XQueueEntry, error) {
+	encoded, err := EncodeValue(codec, value)
+	if err != nil {
+		return XQueueEntry{}, err
+	}
+	return NewXQueueEntry(encoded), nil
+}
+
+// DecodeValue decodes the value of the entry with the codec into v
+func (xqe *XQueueEntry) DecodeValue(codec Codec, v interface{}) error {
+	return DecodeValue(codec, xqe.Value, v)
+}
+
+// Ack marks the entry as done, it's removed from the processing list of its consumer along with its payload
+func (xqe *XQueueEntry) Ack() error {
+	if xqe.c == nil {
+		return fmt.Errorf("queue entry %s isn't consumed", xqe.ReferenceUri)
+	}
+	return ackQueueEntry(xqe.c, xqe.processing, xqe.ReferenceUri)
+}
+
 func (xqe *XQueueEntry) String() string {
 	b, _ := json.Marshal(xqe)
 	return string(b)
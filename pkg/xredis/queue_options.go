@@ -0,0 +1,60 @@
+package xredis
+
+import "time"
+
+// XQueueConsumerOptions contains details of how the queue consumers should be running
+type XQueueConsumerOptions struct {
+	// Consumers is the amount of the consumers running concurrently
+	Consumers int
+	// Consuming is the maximum amount of entries handed to the consumer func at once
+	Consuming int
+	// MaxRetries is how many times a failed entry is queued again before
+	// it's moved to the failed entries of the queue
+	MaxRetries int
+	// ConsumerPrefix is the prefix of the consumer ids, defaults to the queue name
+	ConsumerPrefix string
+}
+
+func NewXQueueConsumerOptions() *XQueueConsumerOptions {
+	return &XQueueConsumerOptions{
+		Consumers:  1,
+		Consuming:  1,
+		MaxRetries: 3,
+	}
+}
+
+func (x *XQueueConsumerOptions) Normalize() {
+	if x.Consumers < 1 {
+		x.Consumers = 1
+	}
+	if x.Consuming < 1 {
+		x.Consuming = 1
+	}
+	if x.MaxRetries < 0 {
+		x.MaxRetries = 0
+	}
+}
+
+// XQueuerOptions contains details of how the entries are enqueued
+type XQueuerOptions struct {
+	// TTL is how long the payloads and the statuses of the entries are kept, defaults to a day
+	TTL time.Duration
+	// DedupWindow is how long an idempotency key deduplicates the entries enqueued after it,
+	// defaults to TTL
+	DedupWindow time.Duration
+}
+
+func NewXQueuerOptions() *XQueuerOptions {
+	return &XQueuerOptions{
+		TTL: queueEntryExpiration,
+	}
+}
+
+func (x *XQueuerOptions) Normalize() {
+	if x.TTL <= 0 {
+		x.TTL = queueEntryExpiration
+	}
+	if x.DedupWindow <= 0 {
+		x.DedupWindow = x.TTL
+	}
+}
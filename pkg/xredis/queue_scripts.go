@@ -0,0 +1,151 @@
+package xredis
+
+import "github.com/go-redis/redis/v8"
+
+// The scripts below move the list queue entries between the queue, the processing lists
+// of the consumers and the failed entries atomically, updating their statuses on the way.
+// The statuses are created along with the entries, the other scripts never create them
+// since they would never expire.
+
+// enqueueQueueEntriesScript stores the payloads of the entries along with their statuses and
+// pushes their references to the queue. The entries with an existing payload are skipped, so are
+// the ones with an idempotency key that's been used within the deduplication window. It returns
+// for each entry 1 if it's enqueued, 0 if it's skipped by its reference, or the reference of
+// the entry enqueued with the same idempotency key.
+// Redis doesn't roll back the writes of a failing script, so the queue is checked before anything
+// is written. A queue key of another type fails the whole batch without leaving any payload or
+// idempotency key behind, once it's checked the writes of the entries don't fail.
+//
+// KEYS: queue, then the referenceUri, the status and the idempotency key (empty if none) of each entry
+// ARGV: expiration in milliseconds, now in unix milliseconds, deduplication window in milliseconds, then the payload of each entry
+var enqueueQueueEntriesScript = redis.NewScript(`
+local kind = redis.call('TYPE', KEYS[1])['ok']
+if kind ~= 'none' and kind ~= 'list' then
+	return redis.error_reply('WRONGTYPE Operation against a key holding the wrong kind of value')
+end
+local results = {}
+for i = 2, #KEYS, 3 do
+	local payload = ARGV[#results + 4]
+	local enqueued = KEYS[i + 2] ~= '' and redis.call('GET', KEYS[i + 2])
+	if enqueued then
+		results[#results + 1] = enqueued
+	elseif redis.call('EXISTS', KEYS[i]) == 1 then
+		results[#results + 1] = 0
+	else
+		-- The consumers pop the references from the right
+		redis.call('LPUSH', KEYS[1], KEYS[i])
+		if KEYS[i + 2] ~= '' then
+			redis.call('SET', KEYS[i + 2], KEYS[i], 'PX', ARGV[3])
+		end
+		redis.call('SET', KEYS[i], payload, 'PX', ARGV[1])
+		-- The status of a previous entry with the same reference is replaced
+		redis.call('DEL', KEYS[i + 1])
+		redis.call('HSET', KEYS[i + 1], 'queue', KEYS[1], 'state', 'queued', 'enqueuedAt', ARGV[2], 'entry', payload)
+		redis.call('PEXPIRE', KEYS[i + 1], ARGV[1])
+		results[#results + 1] = 1
+	end
+end
+return results
+`)
+
+// startQueueEntryScript marks the entry as in progress, the entries enqueued before the statuses
+// existed get one that expires along with their payload
+//
+// KEYS: status, referenceUri
+// ARGV: now in unix milliseconds, queue, entry, expiration in milliseconds if the payload has none
+var startQueueEntryScript = redis.NewScript(`
+redis.call('HSET', KEYS[1], 'state', 'in-progress', 'startedAt', ARGV[1])
+redis.call('HSETNX', KEYS[1], 'queue', ARGV[2])
+redis.call('HSETNX', KEYS[1], 'entry', ARGV[3])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	local ttl = redis.call('PTTL', KEYS[2])
+	if ttl <= 0 then
+		ttl = ARGV[4]
+	end
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// recoverQueueEntriesScript moves the references left in the processing list of a consumer
+// back to the queue, unless the consumer has sent a heartbeat since the cutoff. The newest
+// references are pushed first so the oldest ones are consumed first. It returns the amount
+// of the recovered references, or -1 if the consumer is alive.
+// Note: the status keys are built from the references, therefore the script is not
+// compatible with Redis Cluster.
+//
+// KEYS: queue, consumers, processing list of the consumer
+// ARGV: consumerId, heartbeat cutoff in unix milliseconds, status key prefix
+var recoverQueueEntriesScript = redis.NewScript(`
+local heartbeat = redis.call('ZSCORE', KEYS[2], ARGV[1])
+if heartbeat and tonumber(heartbeat) >= tonumber(ARGV[2]) then
+	return -1
+end
+local recovered = 0
+local ref = redis.call('LPOP', KEYS[3])
+while ref do
+	redis.call('RPUSH', KEYS[1], ref)
+	local status = ARGV[3] .. ref
+	if redis.call('EXISTS', status) == 1 then
+		redis.call('HSET', status, 'state', 'queued')
+	end
+	recovered = recovered + 1
+	ref = redis.call('LPOP', KEYS[3])
+end
+redis.call('ZREM', KEYS[2], ARGV[1])
+return recovered
+`)
+
+// ackQueueEntryScript removes the reference from the processing list, deletes its payload and
+// marks it as done. Nothing changes if the reference wasn't processing since it's been queued again.
+//
+// KEYS: processing list of the consumer, referenceUri, status
+// ARGV: now in unix milliseconds
+var ackQueueEntryScript = redis.NewScript(`
+if redis.call('LREM', KEYS[1], 1, KEYS[2]) == 0 then
+	return 0
+end
+redis.call('DEL', KEYS[2])
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	redis.call('HSET', KEYS[3], 'state', 'done', 'finishedAt', ARGV[1])
+end
+return 1
+`)
+
+// retryQueueEntryScript updates the payload of the processing entry and pushes its reference
+// back to the end of the queue, the payload keeps its expiration
+//
+// KEYS: processing list of the consumer, queue, referenceUri, status
+// ARGV: payload, expiration in milliseconds if the payload has none
+var retryQueueEntryScript = redis.NewScript(`
+if redis.call('LREM', KEYS[1], 1, KEYS[3]) == 0 then
+	return 0
+end
+local ttl = redis.call('PTTL', KEYS[3])
+if ttl <= 0 then
+	ttl = ARGV[2]
+end
+redis.call('SET', KEYS[3], ARGV[1], 'PX', ttl)
+redis.call('LPUSH', KEYS[2], KEYS[3])
+if redis.call('EXISTS', KEYS[4]) == 1 then
+	redis.call('HSET', KEYS[4], 'state', 'queued', 'entry', ARGV[1])
+end
+return 1
+`)
+
+// failQueueEntryScript moves the processing entry to the failed entries of the queue, the failed
+// entries keep the whole entry so its payload is deleted
+//
+// KEYS: processing list of the consumer, failed entries, referenceUri, status
+// ARGV: entry, now in unix milliseconds
+var failQueueEntryScript = redis.NewScript(`
+if redis.call('LREM', KEYS[1], 1, KEYS[3]) == 0 then
+	return 0
+end
+redis.call('DEL', KEYS[3])
+redis.call('RPUSH', KEYS[2], ARGV[1])
+if redis.call('EXISTS', KEYS[4]) == 1 then
+	redis.call('HSET', KEYS[4], 'state', 'failed', 'finishedAt', ARGV[2], 'entry', ARGV[1])
+end
+return 1
+`)
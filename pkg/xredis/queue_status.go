@@ -0,0 +1,90 @@
+package xredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var ErrQueueEntryNotFound = errors.New("queue entry not found")
+
+// XQueueState is the state of a list queue entry in its lifecycle
+type XQueueState string
+
+const (
+	XQueueStateQueued     XQueueState = "queued"
+	XQueueStateInProgress XQueueState = "in-progress"
+	XQueueStateDone       XQueueState = "done"
+	XQueueStateFailed     XQueueState = "failed"
+)
+
+// XQueueValue is a list queue entry along with its state, the timestamps are zero until
+// the entry reaches them. Retried entries are queued again and keep their timestamps.
+type XQueueValue struct {
+	Entry      XQueueEntry `json:"entry"`
+	Queue      string      `json:"queue"`
+	State      XQueueState `json:"state"`
+	EnqueuedAt time.Time   `json:"enqueuedAt"`
+	StartedAt  time.Time   `json:"startedAt"`
+	FinishedAt time.Time   `json:"finishedAt"`
+}
+
+// GetQueueValue returns the entry of the reference URI returned by XQueuer along with its state,
+// the entries are kept for the TTL of their queuer after they're enqueued
+func GetQueueValue(depsCtx context.Context, referenceUri string) (*XQueueValue, error) {
+	rdb, err := GetClient(depsCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := rdb.HGetAll(ctx, queueStatusKey(referenceUri)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrQueueEntryNotFound, referenceUri)
+	}
+	return parseQueueValue(fields)
+}
+
+// startQueueEntry marks the entry as in progress
+func startQueueEntry(rdb *RedisClient, entry XQueueEntry) error {
+	return startQueueEntryScript.Run(
+		ctx,
+		rdb,
+		[]string{queueStatusKey(entry.ReferenceUri), entry.ReferenceUri},
+		unixMilliseconds(time.Now()),
+		entry.queue,
+		entry.String(),
+		durationToMilliseconds(queueEntryExpiration),
+	).Err()
+}
+
+func parseQueueValue(fields map[string]string) (*XQueueValue, error) {
+	value := &XQueueValue{
+		Queue:      fields["queue"],
+		State:      XQueueState(fields["state"]),
+		EnqueuedAt: parseQueueTimestamp(fields["enqueuedAt"]),
+		StartedAt:  parseQueueTimestamp(fields["startedAt"]),
+		FinishedAt: parseQueueTimestamp(fields["finishedAt"]),
+	}
+	if entry, ok := fields["entry"]; ok {
+		parsed, err := parseQueueEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse queue entry: %v -> '%v'", err, entry)
+		}
+		value.Entry = parsed
+	}
+	return value, nil
+}
+
+// parseQueueTimestamp parses unix milliseconds, empty values are zero
+func parseQueueTimestamp(v string) time.Time {
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
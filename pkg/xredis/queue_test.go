@@ -0,0 +1,448 @@
+package xredis_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aminpaks/go-streams/pkg/testrun"
+	"github.com/aminpaks/go-streams/pkg/xredis"
+)
+
+func TestQueueConsumer(t *testing.T) {
+	r := testrun.New(t)
+
+	r.Run(
+		r.It("Should consume the entries in order and ack them", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			queuer, err := xredis.BuildQueuer(depsCtx)
+			assert.Nil(err)
+
+			processed := make(chan xredis.XQueueEntry, 3)
+			options := xredis.NewXQueueConsumerOptions()
+			options.Consuming = 3
+			_, err = xredis.NewQueueConsumer(depsCtx, shutdown, "queue", func(entries ...xredis.XQueueEntry) []error {
+				for _, e := range entries {
+					processed <- e
+				}
+				return nil
+			}, nil, options)
+			assert.Nil(err)
+
+			results, errs := queuer("queue", xredis.NewXQueueEntry("1"), xredis.NewXQueueEntry("2"), xredis.NewXQueueEntry("3"))
+			refs := []string{}
+			for _, result := range results {
+				refs = append(refs, result.ReferenceUri)
+			}
+			assert.Len(errs, 0)
+			for i := range refs {
+				select {
+				case e := <-processed:
+					assert.Equal(fmt.Sprint(i+1), e.Value)
+				case <-time.After(time.Second * 5):
+					assert.FailNow("entry was not processed")
+				}
+			}
+
+			assert.Eventually(func() bool {
+				return client.Exists(context.Background(), refs...).Val() == 0
+			}, time.Second*5, time.Millisecond*10)
+			assert.Equal(int64(0), client.LLen(context.Background(), "queue::queue::processing::"+xredis.ConsumerId("queue", 1)).Val())
+		}),
+
+		r.It("Should recover the entries of the dead consumers", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ctx := context.Background()
+
+			dead := xredis.NewXQueueEntryByReference("dead", xredis.NewUri("users", "1"))
+			alive := xredis.NewXQueueEntryByReference("alive", xredis.NewUri("users", "2"))
+			for consumerId, e := range map[string]xredis.XQueueEntry{"dead-1": dead, "alive-1": alive} {
+				assert.Nil(client.Set(ctx, e.ReferenceUri, e.String(), 0).Err())
+				assert.Nil(client.LPush(ctx, "queue::queue::processing::"+consumerId, e.ReferenceUri).Err())
+			}
+			assert.Nil(client.ZAdd(ctx, "queue::queue::consumers",
+				&redis.Z{Score: 0, Member: "dead-1"},
+				&redis.Z{Score: float64(time.Now().UnixNano() / int64(time.Millisecond)), Member: "alive-1"},
+			).Err())
+
+			processed := make(chan xredis.XQueueEntry, 2)
+			_, err := xredis.NewQueueConsumer(depsCtx, shutdown, "queue", func(entries ...xredis.XQueueEntry) []error {
+				for _, e := range entries {
+					processed <- e
+				}
+				return nil
+			}, nil, nil)
+			assert.Nil(err)
+
+			select {
+			case e := <-processed:
+				assert.Equal(dead.ReferenceUri, e.ReferenceUri)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not recovered")
+			}
+			// The entries of the alive consumers are left alone
+			assert.Equal([]string{alive.ReferenceUri}, client.LRange(ctx, "queue::queue::processing::alive-1", 0, -1).Val())
+			assert.Equal(int64(0), client.Exists(ctx, "queue::queue::processing::dead-1").Val())
+			assert.Equal(redis.Nil, client.ZScore(ctx, "queue::queue::consumers", "dead-1").Err())
+		}),
+
+		r.It("Should retry the failed entries and fail them over once exhausted", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			queuer, err := xredis.BuildQueuer(depsCtx)
+			assert.Nil(err)
+
+			var calls int32
+			failed := make(chan xredis.XFailure, 1)
+			options := xredis.NewXQueueConsumerOptions()
+			options.MaxRetries = 1
+			_, err = xredis.NewQueueConsumer(depsCtx, shutdown, "queue", func(entries ...xredis.XQueueEntry) []error {
+				errs := []error{}
+				for _, e := range entries {
+					atomic.AddInt32(&calls, 1)
+					errs = append(errs, fmt.Errorf("failed %d", e.Retries))
+				}
+				return errs
+			}, func(failures []xredis.XFailure, consumerId string) {
+				for _, f := range failures {
+					failed <- f
+				}
+			}, options)
+			assert.Nil(err)
+
+			results, _ := queuer("queue", xredis.NewXQueueEntry("value"))
+			ref := results[0].ReferenceUri
+			select {
+			case f := <-failed:
+				assert.Equal("retries exhausted: failed 1", f.Err.Error())
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not failed over")
+			}
+			assert.Equal(int32(2), atomic.LoadInt32(&calls))
+
+			entries, err := xredis.ListFailedQueueEntries(client, context.Background(), "queue", 10)
+			assert.Nil(err)
+			if assert.Len(entries, 1) {
+				assert.Equal(ref, entries[0].ReferenceUri)
+				assert.Equal(1, entries[0].Retries)
+				assert.Equal([]string{"failed 0", "failed 1"}, entries[0].Failures)
+			}
+			assert.Equal(int64(0), client.Exists(context.Background(), ref).Val())
+
+			value, err := xredis.GetQueueValue(depsCtx, ref)
+			assert.Nil(err)
+			assert.Equal(xredis.XQueueStateFailed, value.State)
+			assert.Equal(1, value.Entry.Retries)
+			assert.False(value.FinishedAt.IsZero())
+		}),
+
+		r.It("Should keep the entries that can't be read and drop the invalid ones", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			queuer, err := xredis.BuildQueuer(depsCtx)
+			assert.Nil(err)
+
+			ctx := context.Background()
+			results, _ := queuer("queue", xredis.NewXQueueEntry("value"))
+			ref := results[0].ReferenceUri
+			payload := client.Get(ctx, ref).Val()
+			// Reading the payload fails until it's restored
+			assert.Nil(client.Del(ctx, ref).Err())
+			assert.Nil(client.HSet(ctx, ref, "field", "value").Err())
+			assert.Nil(client.LPush(ctx, "queue", "gid://queue/missing").Err())
+
+			processed := make(chan xredis.XQueueEntry, 1)
+			failed := make(chan xredis.XFailure, 10)
+			_, err = xredis.NewQueueConsumer(depsCtx, shutdown, "queue", func(entries ...xredis.XQueueEntry) []error {
+				for _, e := range entries {
+					processed <- e
+				}
+				return nil
+			}, func(failures []xredis.XFailure, consumerId string) {
+				for _, f := range failures {
+					failed <- f
+				}
+			}, xredis.NewXQueueConsumerOptions())
+			assert.Nil(err)
+
+			select {
+			case f := <-failed:
+				assert.Contains(f.Err.Error(), ref)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("read failure was not reported")
+			}
+			assert.Nil(client.Del(ctx, ref).Err())
+			assert.Nil(client.Set(ctx, ref, payload, 0).Err())
+
+			select {
+			case e := <-processed:
+				assert.Equal(ref, e.ReferenceUri)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+			// The entry without a payload is dropped
+			assert.Eventually(func() bool {
+				return client.LLen(ctx, "queue").Val() == 0 &&
+					client.LLen(ctx, "queue::queue::processing::"+xredis.ConsumerId("queue", 1)).Val() == 0
+			}, time.Second*5, time.Millisecond*10)
+		}),
+
+		r.It("Should track the status of the entries", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, _ := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			queuer, err := xredis.BuildQueuer(depsCtx)
+			assert.Nil(err)
+
+			_, err = xredis.GetQueueValue(depsCtx, "gid://queue/missing")
+			assert.True(errors.Is(err, xredis.ErrQueueEntryNotFound))
+
+			results, _ := queuer("queue", xredis.NewXQueueEntry("value"))
+			ref := results[0].ReferenceUri
+			value, err := xredis.GetQueueValue(depsCtx, ref)
+			assert.Nil(err)
+			assert.Equal(xredis.XQueueStateQueued, value.State)
+			assert.Equal("queue", value.Queue)
+			assert.Equal("value", value.Entry.Value)
+			assert.False(value.EnqueuedAt.IsZero())
+			assert.True(value.StartedAt.IsZero())
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			_, err = xredis.NewQueueConsumer(depsCtx, shutdown, "queue", func(entries ...xredis.XQueueEntry) []error {
+				close(started)
+				<-release
+				return nil
+			}, nil, nil)
+			assert.Nil(err)
+
+			<-started
+			value, err = xredis.GetQueueValue(depsCtx, ref)
+			assert.Nil(err)
+			assert.Equal(xredis.XQueueStateInProgress, value.State)
+			assert.False(value.StartedAt.IsZero())
+
+			close(release)
+			assert.Eventually(func() bool {
+				value, err := xredis.GetQueueValue(depsCtx, ref)
+				return err == nil && value.State == xredis.XQueueStateDone && !value.FinishedAt.IsZero()
+			}, time.Second*5, time.Millisecond*10)
+		}),
+
+		r.It("Should run the consumers concurrently and close done on shutdown", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			queuer, err := xredis.BuildQueuer(depsCtx)
+			assert.Nil(err)
+
+			started := make(chan struct{}, 3)
+			release := make(chan struct{})
+			options := xredis.NewXQueueConsumerOptions()
+			options.Consumers = 3
+			done, err := xredis.NewQueueConsumer(depsCtx, shutdown, "queue", func(entries ...xredis.XQueueEntry) []error {
+				started <- struct{}{}
+				<-release
+				return nil
+			}, nil, options)
+			assert.Nil(err)
+
+			queuer("queue", xredis.NewXQueueEntry("1"), xredis.NewXQueueEntry("2"), xredis.NewXQueueEntry("3"))
+			for i := 0; i < 3; i++ {
+				select {
+				case <-started:
+				case <-time.After(time.Second * 5):
+					assert.FailNow("consumers are not concurrent")
+				}
+			}
+
+			cancel()
+			close(release)
+			select {
+			case <-done:
+			case <-time.After(time.Second * 5):
+				assert.FailNow("consumers did not shut down")
+			}
+			assert.Equal(int64(0), client.ZCard(context.Background(), "queue::queue::consumers").Val())
+		}),
+
+		r.It("Should enqueue the entries at once and report the duplicates", func(t *testing.T) {
+			assert := assert.New(t)
+
+			_, client := buildStreamTestMocks(t)
+			ctx := context.Background()
+
+			ref := xredis.NewUri("users", "1")
+			results, err := xredis.EnqueueQueueEntries(client, ctx, "queue",
+				xredis.NewXQueueEntryByReference("1", ref),
+				xredis.NewXQueueEntry("2"),
+				xredis.NewXQueueEntryByReference("3", ref),
+			)
+			assert.Nil(err)
+			if assert.Len(results, 3) {
+				assert.Equal(xredis.XQueueEnqueueResult{ReferenceUri: ref}, results[0])
+				assert.True(strings.HasPrefix(results[1].ReferenceUri, "gid://queue/"))
+				assert.False(results[1].Deduplicated)
+				assert.Equal(xredis.XQueueEnqueueResult{ReferenceUri: ref, Deduplicated: true}, results[2])
+			}
+			assert.Equal(int64(2), client.LLen(ctx, "queue").Val())
+
+			results, err = xredis.EnqueueQueueEntries(client, ctx, "queue", xredis.NewXQueueEntryByReference("4", ref))
+			assert.Nil(err)
+			assert.True(results[0].Deduplicated)
+			assert.Equal(int64(2), client.LLen(ctx, "queue").Val())
+			// The payload of the first entry is kept
+			assert.Contains(client.Get(ctx, ref).Val(), `"value":"1"`)
+		}),
+
+		r.It("Should not leave anything behind if the queue isn't a list", func(t *testing.T) {
+			assert := assert.New(t)
+
+			_, client := buildStreamTestMocks(t)
+			ctx := context.Background()
+			assert.Nil(client.Set(ctx, "queue", "value", 0).Err())
+
+			entry := xredis.NewXQueueEntryByReference("1", xredis.NewUri("users", "1"))
+			entry.IdempotencyKey = "user-1"
+			_, err := xredis.EnqueueQueueEntries(client, ctx, "queue", entry)
+			assert.True(strings.HasPrefix(err.Error(), "WRONGTYPE"))
+			assert.Equal(int64(0), client.Exists(ctx, entry.ReferenceUri, "queue::status::"+entry.ReferenceUri, "queue::queue::idempotency::user-1").Val())
+
+			// Enqueuing again isn't deduplicated once the queue is fixed
+			assert.Nil(client.Del(ctx, "queue").Err())
+			results, err := xredis.EnqueueQueueEntries(client, ctx, "queue", entry)
+			assert.Nil(err)
+			assert.False(results[0].Deduplicated)
+			assert.Equal(int64(1), client.LLen(ctx, "queue").Val())
+		}),
+
+		r.It("Should deduplicate the entries by their idempotency key within the window", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			ctx := context.Background()
+			queuer, err := xredis.BuildQueuerWithOptions(depsCtx, &xredis.XQueuerOptions{TTL: time.Hour, DedupWindow: time.Minute})
+			assert.Nil(err)
+
+			first := xredis.NewXQueueEntry("first")
+			first.IdempotencyKey = "user-1"
+			second := xredis.NewXQueueEntry("second")
+			second.IdempotencyKey = "user-1"
+			results, errs := queuer("queue", first, second)
+			assert.Len(errs, 0)
+			if assert.Len(results, 2) {
+				assert.False(results[0].Deduplicated)
+				assert.Equal(xredis.XQueueEnqueueResult{ReferenceUri: results[0].ReferenceUri, Deduplicated: true}, results[1])
+			}
+			assert.Equal(int64(1), client.LLen(ctx, "queue").Val())
+
+			// The payload and the status expire after the TTL, the key after the window
+			ref := results[0].ReferenceUri
+			assert.Equal(time.Hour, client.PTTL(ctx, ref).Val())
+			assert.Equal(time.Hour, client.PTTL(ctx, "queue::status::"+ref).Val())
+			assert.Equal(time.Minute, client.PTTL(ctx, "queue::queue::idempotency::user-1").Val())
+
+			// Once the window is over the key enqueues again
+			assert.Nil(client.Del(ctx, "queue::queue::idempotency::user-1").Err())
+			results, errs = queuer("queue", second)
+			assert.Len(errs, 0)
+			assert.False(results[0].Deduplicated)
+			assert.NotEqual(ref, results[0].ReferenceUri)
+			assert.Equal(int64(2), client.LLen(ctx, "queue").Val())
+		}),
+	)
+}
+
+// BenchmarkQueuer compares the round trips of the batch script to enqueuing one by one,
+// miniredis runs the scripts slowly so the timings are only meaningful with REDIS_URL
+func BenchmarkQueuer(b *testing.B) {
+	for _, size := range []int{1, 10, 100} {
+		entries := []xredis.XQueueEntry{}
+		for i := 0; i < size; i++ {
+			entries = append(entries, xredis.NewXQueueEntry("value"))
+		}
+
+		b.Run(fmt.Sprintf("one by one/%d", size), func(b *testing.B) {
+			client := buildSortedQueueBenchmarkClient(b)
+			counter := &commandCounter{}
+			client.AddHook(counter)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, entry := range entries {
+					if err := enqueueQueueEntryOneByOne(client, "queue", entry); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&counter.count))/float64(b.N), "cmds/op")
+			client.FlushDB(context.Background())
+		})
+
+		b.Run(fmt.Sprintf("batch/%d", size), func(b *testing.B) {
+			client := buildSortedQueueBenchmarkClient(b)
+			counter := &commandCounter{}
+			client.AddHook(counter)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := xredis.EnqueueQueueEntries(client, context.Background(), "queue", entries...); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&counter.count))/float64(b.N), "cmds/op")
+			client.FlushDB(context.Background())
+		})
+	}
+}
+
+// enqueueQueueEntryOneByOne enqueues the entry the way XQueuer did before the batch script,
+// checking for a duplicate, locking the reference, storing the payload and pushing it separately
+func enqueueQueueEntryOneByOne(client *redis.Client, queueName string, entry xredis.XQueueEntry) error {
+	ctx := context.Background()
+	entry.ReferenceUri = fmt.Sprintf("gid://%s/%s", queueName, uuid.New().String())
+	exist, err := client.Exists(ctx, entry.ReferenceUri).Result()
+	if err != nil || exist == 1 {
+		return err
+	}
+	lockKey := "LOCK::" + entry.ReferenceUri
+	for {
+		if ok, err := client.SetNX(ctx, lockKey, "LOCK", time.Second*10).Result(); err == nil && ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	defer client.Del(ctx, lockKey)
+
+	if err := client.Set(ctx, entry.ReferenceUri, entry.String(), time.Hour*24).Err(); err != nil {
+		return err
+	}
+	return client.LPush(ctx, queueName, entry.ReferenceUri).Err()
+}
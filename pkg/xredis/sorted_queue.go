@@ -5,17 +5,95 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/google/uuid"
 )
 
-type XSortedQueueEntryConsumerFunc func(entries []XSortedQueueEntry, consumerId string) []XSortedQueueEntry
+// ErrSortedQueueLeaseLost is returned when acking, extending, retrying or cleaning up an entry
+// that isn't claimed by its consumer anymore, e.g. its lease expired and it's been queued again
+var ErrSortedQueueLeaseLost = errors.New("sorted queue entry lease lost")
+
+// ErrSortedQueueTimeout is the failure of the entries that weren't processed within BatchTimeout or EntryTimeout
+var ErrSortedQueueTimeout = errors.New("sorted queue entry timed out")
+
+// XSortedQueueEntryConsumerFunc processes a batch of entries, the context is done once the batch
+// exceeds its timeout and the entries that aren't done by then are retried with ErrSortedQueueTimeout
+type XSortedQueueEntryConsumerFunc func(ctx context.Context, entries []XSortedQueueEntry, consumerId string) []XSortedQueueEntry
 type XSortedQueueFailureHandlerFunc func(failures []XFailure, consumerId string)
 
+// XSortedQueueValueConsumerFunc processes a batch of entries along with their decoded values
+type XSortedQueueValueConsumerFunc func(ctx context.Context, values []interface{}, entries []XSortedQueueEntry, consumerId string) []XSortedQueueEntry
+
+// NewSortedQueueValueConsumer decodes the entries with the codec into the values made by
+// newValue before handing them to the consumer. Entries that can't be decoded are never
+// retried, they are passed to the failure handler right away.
+func NewSortedQueueValueConsumer(codec Codec, newValue func() interface{}, consumer XSortedQueueValueConsumerFunc) XSortedQueueEntryConsumerFunc {
+	return func(ctx context.Context, entries []XSortedQueueEntry, consumerId string) []XSortedQueueEntry {
+		values := []interface{}{}
+		decoded := []XSortedQueueEntry{}
+		failed := []XSortedQueueEntry{}
+		for _, e := range entries {
+			value := newValue()
+			if err := e.DecodeValue(codec, value); err != nil {
+				e.setFailure(err)
+				failed = append(failed, e)
+				continue
+			}
+			values = append(values, value)
+			decoded = append(decoded, e)
+		}
+		if len(decoded) == 0 {
+			return failed
+		}
+		return append(consumer(ctx, values, decoded, consumerId), failed...)
+	}
+}
+
+// XSortedQueueEntryHandlerFunc processes a single entry, the entry is retried if it returns an error
+type XSortedQueueEntryHandlerFunc func(ctx context.Context, entry XSortedQueueEntry, consumerId string) error
+
+// NewSortedQueueEntryHandler processes the entries of a batch one by one, each of them within
+// EntryTimeout. Entries that fail or time out are retried, the handler should return as soon as
+// its context is done since it's left running in the background otherwise.
+func NewSortedQueueEntryHandler(handler XSortedQueueEntryHandlerFunc) XSortedQueueEntryConsumerFunc {
+	return func(ctx context.Context, entries []XSortedQueueEntry, consumerId string) []XSortedQueueEntry {
+		for i := range entries {
+			if err := runSortedQueueEntryHandler(ctx, handler, entries[i], consumerId); err != nil {
+				entries[i].Retry(err)
+			}
+		}
+		return entries
+	}
+}
+
+func runSortedQueueEntryHandler(ctx context.Context, handler XSortedQueueEntryHandlerFunc, entry XSortedQueueEntry, consumerId string) error {
+	if entry.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, entry.timeout)
+		defer cancel()
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("PANIC: %v", r)
+			}
+		}()
+		done <- handler(ctx, entry, consumerId)
+	}()
+	select {
+	case err := <-done:
+		if err != nil && ctx.Err() != nil {
+			// The handler gave up because of the timeout
+			return fmt.Errorf("%w: %v", ErrSortedQueueTimeout, err)
+		}
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrSortedQueueTimeout, ctx.Err())
+	}
+}
+
 func NewSortedQueueConsumer(
 	client *RedisClient,
 	ctx context.Context,
@@ -41,19 +119,62 @@ func NewSortedQueueConsumerWithOptions(
 
 	done := make(chan struct{})
 	wg := sync.WaitGroup{}
-	wg.Add(options.Consumers)
-	for i := 0; i < options.Consumers; i++ {
-		consumerId := uuid.New().String()
+	if options.ConsumerPrefix == "" {
+		options.ConsumerPrefix = queue
+	}
+	// Revives the entries once before any consumer starts claiming,
+	// otherwise a consumer could revive the entries another one is processing
+	internalProcessMissingSortedEntries(client, ctx, ConsumerId(options.ConsumerPrefix, 1), queue, failureHandler)
+	// Removes the expired dead letters
+	if options.DeadLetterRetention > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runSortedQueueDeadLetterCleaner(client, ctx, ConsumerId(options.ConsumerPrefix, 1), queue, failureHandler, *options)
+		}()
+	}
+	// Requeues the entries of hung consumers while running
+	if options.VisibilityTimeout > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runSortedQueueReaper(client, ctx, ConsumerId(options.ConsumerPrefix, 1), queue, failureHandler, *options)
+		}()
+	}
+	waiter := newSortedQueueWaiter(*options)
+	var metrics *sortedQueueMetrics
+	// Reports the amount of the running consumers to the controller and the change callback
+	running := 0
+	runningMutex := sync.Mutex{}
+	addConsumers := func(delta int) {
+		options.Controller.addConsumers(delta)
+		if options.OnConsumersChange == nil {
+			return
+		}
+		runningMutex.Lock()
+		defer runningMutex.Unlock()
+		running += delta
+		options.OnConsumersChange(running)
+	}
+	// Runs a consumer until shutdown or until the stop channel is closed by the scaler
+	start := func(consumerId string, stop chan struct{}) {
+		wg.Add(1)
+		addConsumers(1)
 		go func() {
+			defer func() {
+				addConsumers(-1)
+				wg.Done()
+			}()
 			log.Printf("running sorted queue consumer %s", consumerId)
-			internalProcessMissingSortedEntries(client, ctx, consumerId, queue, failureHandler)
 			for {
-				internalConsumeSortedQueue(client, ctx, consumerId, queue, entryConsumer, failureHandler, *options)
+				internalConsumeSortedQueue(client, ctx, consumerId, queue, entryConsumer, failureHandler, waiter, metrics, *options)
 
 				select {
 				case <-ctx.Done():
 					log.Printf("consumer %s is done", consumerId)
-					wg.Done()
+					return
+				case <-stop:
+					log.Printf("consumer %s is scaled down", consumerId)
 					return
 				default:
 					continue
@@ -61,6 +182,20 @@ func NewSortedQueueConsumerWithOptions(
 			}
 		}()
 	}
+	if options.isAutoscaling() {
+		scaler := newSortedQueueScaler(client, queue, *options, start)
+		metrics = scaler.metrics
+		scaler.scaleTo(options.Consumers)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scaler.run(ctx)
+		}()
+	} else {
+		for i := 0; i < options.Consumers; i++ {
+			start(ConsumerId(options.ConsumerPrefix, i+1), nil)
+		}
+	}
 	// This go routine will make sure we close the channel once all the consumers
 	// safely completed their work on shuting down
 	go func() {
@@ -78,9 +213,45 @@ func internalConsumeSortedQueue(
 	queue string,
 	entryConsumer XSortedQueueEntryConsumerFunc,
 	failureHandler XSortedQueueFailureHandlerFunc,
+	waiter *sortedQueueWaiter,
+	metrics *sortedQueueMetrics,
 	options XSortedQueueOptions,
 ) {
-	rawEntries, err := client.ZPopMin(shutdown, queue, options.Consuming).Result()
+	// Drained consumers stop claiming, in-flight batches are tracked until they're finished
+	if !options.Controller.acquire() {
+		time.Sleep(sortedQueuePollInterval)
+		return
+	}
+	acquired := true
+	defer func() {
+		if acquired {
+			options.Controller.release()
+		}
+	}()
+
+	// Pops the entries and marks them for processing in a single step,
+	// so the entries are never lost if the consumer crashes in between
+	claimed, paused, err := claimSortedQueueEntries(client, shutdown, queue, options.Consuming, options.VisibilityTimeout)
+	if paused {
+		time.Sleep(sortedQueuePollInterval)
+		return
+	}
+	if err == nil && len(claimed) == 0 && waiter.isBlocking() {
+		// Waits for an entry to be queued and claims the batch, the entries
+		// stay in the queue until they're claimed so nothing is lost if the
+		// consumer crashes or shuts down in between
+		// The consumer isn't in-flight while it's waiting, so draining doesn't wait for it
+		options.Controller.release()
+		var notified bool
+		notified, err = waiter.wait(client, shutdown, queue, options)
+		// Consumers drained while waiting don't claim the entries they've been notified about
+		if acquired = options.Controller.acquire(); !acquired {
+			return
+		}
+		if err == nil && notified {
+			claimed, _, err = claimSortedQueueEntries(client, shutdown, queue, options.Consuming, options.VisibilityTimeout)
+		}
+	}
 	if err != nil {
 		if !strings.HasPrefix(err.Error(), "context canceled") {
 			failureHandler([]XFailure{{Err: fmt.Errorf("failed to read queue: %v", err)}}, consumerId)
@@ -91,47 +262,64 @@ func internalConsumeSortedQueue(
 		}
 		return
 	}
+	metrics.recordClaim(len(claimed))
 
-	if len(rawEntries) > 0 {
+	if len(claimed) > 0 {
 		queueFailures := []XFailure{}
 		entries := []XSortedQueueEntry{}
-		for _, e := range rawEntries {
-			// Reads entry value by its reference URI via Redis.Get()
-			entryValue, err := getXSortedQueueEntryByUri(client, e.Member)
-			if err != nil {
-				// Appends entry reference URI for failure report
-				queueFailures = append(queueFailures, XFailure{Err: err, Payload: XGenericMap{"value": e.Member}})
+		for _, c := range claimed {
+			if !IsValidUri(c.ReferenceUri) {
+				queueFailures = append(queueFailures, XFailure{Err: fmt.Errorf("invalid URI: %v", c.ReferenceUri), Payload: XGenericMap{"value": c.ReferenceUri}})
+				continue
+			}
+			if c.Payload == nil {
+				queueFailures = append(queueFailures, XFailure{Err: fmt.Errorf("failed to read from URI %v", c.ReferenceUri), Payload: XGenericMap{"value": c.ReferenceUri}})
 				continue
 			}
 			// Parses sorted queue entry
-			entry, err := parseXSortedQueueEntry(entryValue)
+			entry, err := parseXSortedQueueEntry(*c.Payload)
 			if err != nil {
+				// Entries that can't be parsed will never succeed, the raw payload is kept as the dead letter value
+				invalid := XSortedQueueEntry{queue: queue, token: c.Token, Value: *c.Payload, Priority: c.Priority, ReferenceUri: c.ReferenceUri, Failures: []string{}}
+				invalid.setFailure(err)
+				if err := deadLetterSortedQueueEntry(client, consumerId, invalid); err != nil {
+					queueFailures = append(queueFailures, XFailure{Err: err, Payload: XGenericMap{"referenceUri": c.ReferenceUri}})
+				}
 				// Appends entry value for failure report
-				queueFailures = append(queueFailures, XFailure{Err: err, Payload: XGenericMap{"referenceUri": e.Member, "value": entryValue}})
+				queueFailures = append(queueFailures, XFailure{Err: invalid.currentFailure, Payload: XGenericMap{"referenceUri": c.ReferenceUri, "value": *c.Payload}})
 				continue
 			}
 			// Updates the entry max retries field
 			entry.maxRetries = options.MaxRetries
+			// Updates the entry timeout used by the entry handlers
+			entry.timeout = options.EntryTimeout
 			// Set queue name
 			entry.queue = queue
+			// Set the claim token, the entry can only be changed by this consumer as long as it matches
+			entry.token = c.Token
+			// The expired leases count as failed attempts, so an entry that hangs its consumers runs out of retries
+			if c.Reaps > 0 {
+				entry.CurrentRetries += c.Reaps
+				entry.Failures = append(entry.Failures, fmt.Sprintf("%v: expired leases: %d", ErrSortedQueueTimeout, c.Reaps))
+			}
 			// Set redis client for internal usage
 			entry.setClient(client)
 			if entry.HasExhaustedRetries() {
-				// Exhausted retries should be passed to failure handler
-				queueFailures = append(queueFailures, XFailure{Err: errors.New("retries exhausted"), Payload: XGenericMap{"entry": *entry}})
+				// Exhausted entries are moved to the dead letters and passed to failure handler
+				err := errors.New("retries exhausted")
+				if dlqErr := deadLetterSortedQueueEntry(client, consumerId, *entry); dlqErr != nil {
+					err = fmt.Errorf("%v: %v", err, dlqErr)
+				}
+				queueFailures = append(queueFailures, XFailure{Err: err, Payload: XGenericMap{"entry": *entry}})
 			} else {
 				// Appends for processing
 				entries = append(entries, *entry)
 			}
 		}
 		if len(entries) > 0 {
-			if err := markSortedEntryForProcessing(client, queue, entries...); err != nil {
-				for _, e := range entries {
-					queueFailures = append(queueFailures, XFailure{Err: err, Payload: XGenericMap{"entry": e}})
-				}
-			} else {
-				queueFailures = append(queueFailures, handleXSortedQueueEntries(client, consumerId, queue, entryConsumer, entries, options)...)
-			}
+			startedAt := time.Now()
+			queueFailures = append(queueFailures, handleXSortedQueueEntries(client, consumerId, queue, entryConsumer, entries, options)...)
+			metrics.recordBatch(time.Since(startedAt))
 		}
 		if len(queueFailures) > 0 {
 			// Reports the failures to failure handler
@@ -139,9 +327,10 @@ func internalConsumeSortedQueue(
 		}
 	}
 
-	// Either we should use BZPopMin which requires Redis 7.0
-	// or this is required to slow down the CPU usage of the consumers
-	time.Sleep(time.Millisecond * 100)
+	// Polling consumers have to slow down to spare the CPU of the consumers and the server
+	if !waiter.isBlocking() {
+		time.Sleep(sortedQueuePollInterval)
+	}
 }
 
 func handleXSortedQueueEntries(
@@ -152,97 +341,114 @@ func handleXSortedQueueEntries(
 	entries []XSortedQueueEntry,
 	options XSortedQueueOptions,
 ) (failures []XFailure) {
-	defer func() {
-		if r := recover(); r != nil {
-			for _, entry := range entries {
-				if ok, err := client.SIsMember(context.Background(), sortedQueueProcessingReferenceKey(queue), entry.ReferenceUri).Result(); err == nil && ok {
-					entry.setFailure(fmt.Errorf("PANIC: %v", r))
-					if err := retrySortedQueueEntry(client, entry); err != nil {
-						failures = append(failures, XFailure{Err: err, Payload: XGenericMap{"entry": entry}})
-					}
-				}
+	// The batch isn't cancelled on shutdown, in-flight batches are finished as usual
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	timeout := options.batchTimeout(len(entries))
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	// The consumer works on its own copy of the entries since it might
+	// still be running after the batch has timed out
+	batch := make([]XSortedQueueEntry, len(entries))
+	for i, e := range entries {
+		e.Failures = append([]string{}, e.Failures...)
+		batch[i] = e
+	}
+	processed := make(chan []XSortedQueueEntry, 1)
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked <- r
 			}
-		}
+		}()
+		processed <- consumer(ctx, batch, consumerId)
 	}()
 
-	for _, e := range consumer(entries, consumerId) {
-		// Checks if consumer has marked the entry with failure
-		if e.currentFailure != nil {
-			// We retry the failed entries by adding them back to the queue with in lower priority
-			// and the Background context we provide here is not cancellable
-			if err := retrySortedQueueEntry(client, e); err != nil {
-				failures = append(failures, XFailure{Err: err, Payload: XGenericMap{"entry": e}})
+	select {
+	case r := <-panicked:
+		return retryProcessingSortedQueueEntries(client, consumerId, queue, entries, fmt.Errorf("PANIC: %v", r), options)
+	case <-ctx.Done():
+		log.Printf("consumer '%s' timed out processing %d entries of sorted queue '%s' after %s", consumerId, len(entries), queue, timeout)
+		return retryProcessingSortedQueueEntries(client, consumerId, queue, entries, fmt.Errorf("%w: batch not done after %s", ErrSortedQueueTimeout, timeout), options)
+	case result := <-processed:
+		for _, e := range result {
+			// Checks if consumer has marked the entry with failure
+			if e.currentFailure != nil {
+				// We retry the failed entries by adding them back to the queue with in lower priority
+				// and the Background context we provide here is not cancellable
+				if err := retrySortedQueueEntry(client, consumerId, e, options.RetryPolicy); err != nil {
+					failures = append(failures, XFailure{Err: err, Payload: XGenericMap{"entry": e}})
+				}
 				continue
 			}
-			continue
+			// Clean up the resource after successfully processed
+			if err := cleanSortedQueueEntry(client, e); err != nil {
+				failures = append(failures, XFailure{Err: err, Payload: XGenericMap{"entry": e}})
+			}
 		}
-		// Clean up the resource after successfully processed
-		cleanSortedQueueEntry(client, e)
+		return failures
 	}
+}
 
+// retryProcessingSortedQueueEntries retries the entries the consumer hasn't acked or cleaned up yet with the failure
+func retryProcessingSortedQueueEntries(
+	client *RedisClient,
+	consumerId string,
+	queue string,
+	entries []XSortedQueueEntry,
+	failure error,
+	options XSortedQueueOptions,
+) (failures []XFailure) {
+	for _, entry := range entries {
+		entry.setFailure(failure)
+		// The entries the consumer has acked already aren't claimed with their token anymore
+		if err := retrySortedQueueEntry(client, consumerId, entry, options.RetryPolicy); err != nil && !errors.Is(err, ErrSortedQueueLeaseLost) {
+			failures = append(failures, XFailure{Err: err, Payload: XGenericMap{"entry": entry}})
+		}
+	}
 	return failures
 }
 
-func retrySortedQueueEntry(client *RedisClient, entry XSortedQueueEntry) error {
-	// Checks if retries have been exhausted or not
-	if entry.IsLastRetry() {
-		// Reports the entry to failure handler
-		return errors.New("retries exhausted")
+func retrySortedQueueEntry(client *RedisClient, consumerId string, entry XSortedQueueEntry, policy RetryPolicy) error {
+	// Entries that can't be decoded will never succeed and
+	// the ones that have exhausted their retries are done
+	var err error
+	if errors.Is(entry.currentFailure, ErrDecode) {
+		err = entry.currentFailure
+	} else if entry.IsLastRetry() {
+		err = errors.New("retries exhausted")
+	}
+	if err != nil {
+		// Moves the entry to the dead letters and reports it to failure handler
+		if dlqErr := deadLetterSortedQueueEntry(client, consumerId, entry); dlqErr != nil {
+			return fmt.Errorf("%v: %w", err, dlqErr)
+		}
+		return err
 	}
-	// Next line will attempt to lower the priority and enqueue the entry to be processed again
-	// Note: Higher numbers have lower priority, we increase the entry's priority by 10%
-	entry.Priority = entry.Priority * 1.1
-	// We retry the failed entries by adding them back to the queue with in lower priority
+	// The policy decides the new priority of the entry and when it's processed again
+	priority, delay := policy.Next(entry)
+	entry.Priority = priority
+	// We retry the failed entries by adding them back to the queue
 	// and the Background context we provide here is not cancellable
-	if err := enqueueSortedEntryWithPayload(client, context.Background(), entry.queue, entry, entry.CurrentRetries+1); err != nil {
-		return fmt.Errorf("failed to retry: %v", err)
+	if err := retrySortedQueueEntryWithPayload(client, entry, entry.CurrentRetries+1, delay); err != nil {
+		return fmt.Errorf("failed to retry: %w", err)
 	}
 
 	return nil
 }
 
+// internalProcessMissingSortedEntries moves the entries left in processing without a lease
+// by the consumers that didn't shut down gracefully back to the queue
 func internalProcessMissingSortedEntries(client *RedisClient, ctx context.Context, consumerId string, queue string, failureHandler XSortedQueueFailureHandlerFunc) {
-	unlock := lock(client, queue)
-	defer unlock()
-
-	v, err := client.SMembers(ctx, sortedQueueProcessingReferenceKey(queue)).Result()
+	revived, err := reviveSortedQueueEntries(client, ctx, queue)
 	if err != nil {
-		log.Printf("failed: %v", err)
-	}
-	successRefs := []string{}
-	failures := []XFailure{}
-	for _, ref := range v {
-		priorityStr, err := client.HGet(context.Background(), sortedQueueProcessingPriorityKey(queue), ref).Result()
-		if err != nil {
-			failures = append(failures, XFailure{Err: fmt.Errorf("failed to revive processing sorted queue: %v", err), Payload: XGenericMap{"referenceUri": ref}})
-			continue
-		}
-		priority, err := strconv.ParseFloat(priorityStr, 64)
-		if err != nil {
-			failures = append(failures, XFailure{Err: fmt.Errorf("failed to decode sorted queue priority: %v", err), Payload: XGenericMap{"referenceUri": ref, "priorityStr": priorityStr}})
-			continue
-		}
-		if err := enqueueSortedEntry(client, ctx, queue, ref, priority); err != nil {
-			failures = append(failures, XFailure{Err: fmt.Errorf("failed to enqueue sorted queue entry: %v", err), Payload: XGenericMap{"referenceUri": ref, "priority": priority}})
-			continue
-		}
-		successRefs = append(successRefs, ref)
-		log.Printf("ref %s priority %v", ref, priorityStr)
-	}
-
-	// All the removing functions should rely on the cancel context
-	// to avoid removing elements from the lists if the operation should be cancelled
-	for _, ref := range successRefs {
-		if err := client.HDel(ctx, sortedQueueProcessingPriorityKey(queue), ref).Err(); err != nil {
-			failures = append(failures, XFailure{Err: fmt.Errorf("failed to clean up priority hash: %v", err), Payload: XGenericMap{"referenceUri": ref}})
-			continue
-		}
-		if err := client.SRem(ctx, sortedQueueProcessingReferenceKey(queue), ref).Err(); err != nil {
-			failures = append(failures, XFailure{Err: fmt.Errorf("failed to remove reference from processing set: %v", err), Payload: XGenericMap{"referenceUri": ref}})
-		}
+		failureHandler([]XFailure{{Err: fmt.Errorf("failed to revive processing sorted queue: %v", err)}}, consumerId)
+		return
 	}
-
-	if len(failures) > 0 {
-		failureHandler(failures, consumerId)
+	if revived > 0 {
+		log.Printf("revived %d processing entries of sorted queue %s", revived, queue)
 	}
 }
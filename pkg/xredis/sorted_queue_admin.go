@@ -0,0 +1,236 @@
+package xredis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var ErrSortedQueueEntryNotFound = errors.New("sorted queue entry not found")
+
+// sortedQueueAdminAttempts is how many times an optimistic update is attempted
+const sortedQueueAdminAttempts = 5
+
+// SortedQueue is a handle to inspect and manage the entries of a sorted queue,
+// it understands the key layout of the queue and its processing entries
+type SortedQueue struct {
+	client *RedisClient
+	name   string
+}
+
+// XSortedQueueProcessingEntry is an entry claimed by a consumer
+type XSortedQueueProcessingEntry struct {
+	Entry XSortedQueueEntry `json:"entry"`
+	// LeaseDeadline is when the entry is queued again, it's zero if the entry isn't leased
+	LeaseDeadline time.Time `json:"leaseDeadline"`
+}
+
+func NewSortedQueue(client *RedisClient, name string) *SortedQueue {
+	return &SortedQueue{client: client, name: name}
+}
+
+func (q *SortedQueue) Name() string {
+	return q.name
+}
+
+// Len returns the amount of the entries waiting in the queue, excluding
+// the scheduled entries that aren't due yet and the processing ones
+func (q *SortedQueue) Len(ctx context.Context) (int64, error) {
+	return q.client.ZCard(ctx, q.name).Result()
+}
+
+// Peek returns up to n entries in the order they will be consumed without claiming them.
+// Entries that have lost their payload are returned with their reference and priority only.
+func (q *SortedQueue) Peek(ctx context.Context, n int64) ([]XSortedQueueEntry, error) {
+	if n < 1 {
+		return []XSortedQueueEntry{}, nil
+	}
+	refs, err := q.client.ZRangeWithScores(ctx, q.name, 0, n-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, z := range refs {
+		keys = append(keys, fmt.Sprint(z.Member))
+	}
+	payloads, err := q.getPayloads(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []XSortedQueueEntry{}
+	for i, z := range refs {
+		entries = append(entries, q.buildEntry(keys[i], z.Score, payloads[i]))
+	}
+	return entries, nil
+}
+
+// Get returns the entry by its reference URI, whether it's queued, scheduled or processing
+func (q *SortedQueue) Get(ctx context.Context, referenceUri string) (*XSortedQueueEntry, error) {
+	payload, err := q.client.Get(ctx, referenceUri).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, fmt.Errorf("%w: %s", ErrSortedQueueEntryNotFound, referenceUri)
+		}
+		return nil, err
+	}
+	entry, err := parseXSortedQueueEntry(payload)
+	if err != nil {
+		return nil, err
+	}
+	entry.queue = q.name
+	return entry, nil
+}
+
+// Remove removes the entry from the queue, the scheduled or the processing entries along
+// with its payload. A consumer processing the entry isn't interrupted.
+func (q *SortedQueue) Remove(ctx context.Context, referenceUri string) error {
+	removed, err := removeSortedEntryScript.Run(ctx, q.client, append(q.keys(), referenceUri)).Int()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return fmt.Errorf("%w: %s", ErrSortedQueueEntryNotFound, referenceUri)
+	}
+	return nil
+}
+
+// SetPriority changes the priority of the entry, processing entries keep
+// the new priority if they're queued again
+func (q *SortedQueue) SetPriority(ctx context.Context, referenceUri string, priority float64) error {
+	// The payload is updated optimistically, we try again if a consumer changes it in between
+	for attempt := 0; attempt < sortedQueueAdminAttempts; attempt++ {
+		payload, updated, err := q.withPriority(ctx, referenceUri, priority)
+		if err != nil {
+			return err
+		}
+		result, err := setSortedEntryPriorityScript.Run(ctx, q.client, append(q.keys(), referenceUri), priority, payload, updated).Int()
+		if err != nil {
+			return err
+		}
+		switch result {
+		case -1:
+			continue
+		case 0:
+			return fmt.Errorf("%w: %s", ErrSortedQueueEntryNotFound, referenceUri)
+		default:
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to set the priority of %s, the entry kept changing", referenceUri)
+}
+
+// withPriority returns the current payload of the entry and the payload with the new priority,
+// both are empty if the payload doesn't exist
+func (q *SortedQueue) withPriority(ctx context.Context, referenceUri string, priority float64) (string, string, error) {
+	payload, err := q.client.Get(ctx, referenceUri).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	var e internalPersistedXSortedQueueEntry
+	if err := json.Unmarshal([]byte(payload), &e); err != nil {
+		return "", "", fmt.Errorf("failed to parse entry: %v", err)
+	}
+	e.Priority = priority
+	b, _ := json.Marshal(e)
+	return payload, string(b), nil
+}
+
+// ListProcessing returns the entries claimed by the consumers
+func (q *SortedQueue) ListProcessing(ctx context.Context) ([]XSortedQueueProcessingEntry, error) {
+	refs, err := q.client.SMembers(ctx, sortedQueueProcessingReferenceKey(q.name)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 {
+		return []XSortedQueueProcessingEntry{}, nil
+	}
+
+	priorities := []*redis.StringCmd{}
+	leases := []*redis.FloatCmd{}
+	if _, err := q.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, ref := range refs {
+			priorities = append(priorities, pipe.HGet(ctx, sortedQueueProcessingPriorityKey(q.name), ref))
+			leases = append(leases, pipe.ZScore(ctx, sortedQueueProcessingLeasesKey(q.name), ref))
+		}
+		return nil
+	}); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	payloads, err := q.getPayloads(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []XSortedQueueProcessingEntry{}
+	for i, ref := range refs {
+		priority, _ := strconv.ParseFloat(priorities[i].Val(), 64)
+		entry := XSortedQueueProcessingEntry{Entry: q.buildEntry(ref, priority, payloads[i])}
+		if deadline, err := leases[i].Result(); err == nil {
+			entry.LeaseDeadline = time.Unix(0, int64(deadline)*int64(time.Millisecond))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ListFailed returns up to count dead letters of the queue, oldest first
+func (q *SortedQueue) ListFailed(ctx context.Context, count int64) ([]XSortedQueueDeadLetter, error) {
+	return ListSortedQueueDeadLetters(q.client, ctx, q.name, count)
+}
+
+// RequeueFailed enqueues the dead letter again with its retries reset
+func (q *SortedQueue) RequeueFailed(ctx context.Context, referenceUri string) error {
+	return RequeueSortedQueueDeadLetter(q.client, ctx, q.name, referenceUri)
+}
+
+// PurgeFailed removes the given dead letters, or all of them if no reference URIs are provided
+func (q *SortedQueue) PurgeFailed(ctx context.Context, referenceUris ...string) error {
+	return PurgeSortedQueueDeadLetters(q.client, ctx, q.name, referenceUris...)
+}
+
+// keys returns the keys of the queue in the order the admin scripts expect them
+func (q *SortedQueue) keys() []string {
+	return []string{
+		q.name,
+		sortedQueueScheduledReferenceKey(q.name),
+		sortedQueueScheduledPriorityKey(q.name),
+		sortedQueueProcessingReferenceKey(q.name),
+		sortedQueueProcessingPriorityKey(q.name),
+		sortedQueueProcessingLeasesKey(q.name),
+		sortedQueueProcessingTokensKey(q.name),
+		sortedQueueReapsKey(q.name),
+	}
+}
+
+func (q *SortedQueue) getPayloads(ctx context.Context, refs []string) ([]interface{}, error) {
+	if len(refs) == 0 {
+		return []interface{}{}, nil
+	}
+	return q.client.MGet(ctx, refs...).Result()
+}
+
+func (q *SortedQueue) buildEntry(referenceUri string, priority float64, payload interface{}) XSortedQueueEntry {
+	if value, ok := payload.(string); ok {
+		entry, err := parseXSortedQueueEntry(value)
+		if err == nil {
+			// The priority the entry is stored with in the queue is the source of truth
+			entry.Priority = priority
+			entry.queue = q.name
+			return *entry
+		}
+		log.Printf("failed to decode sorted queue entry %s: %v", referenceUri, err)
+	}
+	entry := NewXSortedQueueEntry("", priority, referenceUri, 0)
+	entry.queue = q.name
+	return entry
+}
@@ -0,0 +1,41 @@
+package xredis
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// sortedQueueWaiter blocks the consumers of a queue with BLPOP on the notifications of the
+// queue until an entry is queued. The entries are only ever popped by the claim script, so
+// a consumer waking up doesn't take anything out of the queue.
+type sortedQueueWaiter struct {
+	enabled bool
+}
+
+func newSortedQueueWaiter(options XSortedQueueOptions) *sortedQueueWaiter {
+	return &sortedQueueWaiter{enabled: options.Blocking}
+}
+
+// isBlocking returns true if the consumers should block instead of polling
+func (w *sortedQueueWaiter) isBlocking() bool {
+	return w != nil && w.enabled
+}
+
+// wait blocks for up to BlockTimeout until an entry is queued, it returns false if the
+// timeout is reached. The scheduled entries don't notify once they're due, they're
+// claimed once the consumer wakes up after the timeout.
+func (w *sortedQueueWaiter) wait(client *RedisClient, shutdown context.Context, queue string, options XSortedQueueOptions) (bool, error) {
+	if err := client.BLPop(shutdown, options.BlockTimeout, sortedQueueNotifyKey(queue)).Err(); err != nil {
+		if err == redis.Nil {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func isUnknownCommandError(err error) bool {
+	return strings.HasPrefix(strings.ToLower(err.Error()), "err unknown command")
+}
@@ -0,0 +1,121 @@
+package xredis
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SortedQueueController pauses, resumes and drains the consumers of a sorted queue.
+// Pausing is stored in Redis so it's visible to the consumers of all the instances,
+// draining only stops the consumers registered with this controller.
+type SortedQueueController struct {
+	client *RedisClient
+	queue  string
+
+	m         sync.Mutex
+	draining  bool
+	inFlight  int
+	consumers int
+}
+
+func NewSortedQueueController(client *RedisClient, queue string) *SortedQueueController {
+	return &SortedQueueController{client: client, queue: queue}
+}
+
+// Pause stops the consumers of all the instances from claiming new entries,
+// the entries being processed are finished as usual
+func (c *SortedQueueController) Pause(ctx context.Context) error {
+	return c.client.Set(ctx, sortedQueuePausedKey(c.queue), time.Now().Format(time.RFC3339), 0).Err()
+}
+
+// Resume lets the consumers of all the instances claim entries again,
+// including the local consumers that have been drained
+func (c *SortedQueueController) Resume(ctx context.Context) error {
+	if err := c.client.Del(ctx, sortedQueuePausedKey(c.queue)).Err(); err != nil {
+		return err
+	}
+	c.m.Lock()
+	c.draining = false
+	c.m.Unlock()
+	return nil
+}
+
+// IsPaused returns true if the queue is paused
+func (c *SortedQueueController) IsPaused(ctx context.Context) (bool, error) {
+	n, err := c.client.Exists(ctx, sortedQueuePausedKey(c.queue)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Drain stops the local consumers from claiming new entries and waits until
+// their in-flight batches are finished or the context is done
+func (c *SortedQueueController) Drain(ctx context.Context) error {
+	c.m.Lock()
+	c.draining = true
+	c.m.Unlock()
+
+	for {
+		c.m.Lock()
+		inFlight := c.inFlight
+		c.m.Unlock()
+		if inFlight == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+// IsDraining returns true if the local consumers have been drained
+func (c *SortedQueueController) IsDraining() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.draining
+}
+
+// Consumers returns the amount of the local consumers currently running
+func (c *SortedQueueController) Consumers() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.consumers
+}
+
+func (c *SortedQueueController) addConsumers(delta int) {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	c.consumers += delta
+	c.m.Unlock()
+}
+
+// acquire registers an in-flight batch, it returns false if the consumers are draining
+func (c *SortedQueueController) acquire() bool {
+	if c == nil {
+		return true
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.draining {
+		return false
+	}
+	c.inFlight++
+	return true
+}
+
+// release marks an in-flight batch as finished
+func (c *SortedQueueController) release() {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	c.inFlight--
+	c.m.Unlock()
+}
@@ -0,0 +1,190 @@
+package xredis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var ErrSortedQueueDeadLetter = errors.New("sorted queue dead letter")
+
+// XSortedQueueDeadLetter is a sorted queue entry that has exhausted its retries
+// or can never succeed, the entry keeps the history of its failures
+type XSortedQueueDeadLetter struct {
+	Entry      XSortedQueueEntry `json:"entry"`
+	Queue      string            `json:"queue"`
+	ConsumerId string            `json:"consumerId"`
+	FailedAt   time.Time         `json:"failedAt"`
+}
+
+// ListSortedQueueDeadLetters returns up to count dead letters of the queue, oldest first
+func ListSortedQueueDeadLetters(client *RedisClient, ctx context.Context, queue string, count int64) ([]XSortedQueueDeadLetter, error) {
+	refs, err := client.ZRange(ctx, sortedQueueDeadReferenceKey(queue), 0, count-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSortedQueueDeadLetter, err)
+	}
+	if len(refs) == 0 {
+		return []XSortedQueueDeadLetter{}, nil
+	}
+	values, err := client.HMGet(ctx, sortedQueueDeadPayloadKey(queue), refs...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSortedQueueDeadLetter, err)
+	}
+
+	deadLetters := []XSortedQueueDeadLetter{}
+	for i, v := range values {
+		value, ok := v.(string)
+		if !ok {
+			// Purged between the two reads
+			continue
+		}
+		deadLetter, err := parseSortedQueueDeadLetter(value)
+		if err != nil {
+			log.Printf("failed to decode dead letter %s: %v", refs[i], err)
+			continue
+		}
+		deadLetters = append(deadLetters, *deadLetter)
+	}
+	return deadLetters, nil
+}
+
+// GetSortedQueueDeadLetter returns the dead letter of the queue by its reference URI
+func GetSortedQueueDeadLetter(client *RedisClient, ctx context.Context, queue string, referenceUri string) (*XSortedQueueDeadLetter, error) {
+	value, err := client.HGet(ctx, sortedQueueDeadPayloadKey(queue), referenceUri).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, fmt.Errorf("%w: %s not found", ErrSortedQueueDeadLetter, referenceUri)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrSortedQueueDeadLetter, err)
+	}
+	return parseSortedQueueDeadLetter(value)
+}
+
+// RequeueSortedQueueDeadLetter enqueues the entry of the dead letter again with its
+// retries reset, and removes it from the dead letters
+func RequeueSortedQueueDeadLetter(client *RedisClient, ctx context.Context, queue string, referenceUri string) error {
+	deadLetter, err := GetSortedQueueDeadLetter(client, ctx, queue, referenceUri)
+	if err != nil {
+		return err
+	}
+	entry := deadLetter.Entry
+	entry.CurrentRetries = 0
+	requeued, err := requeueDeadSortedEntryScript.Run(
+		ctx,
+		client,
+		[]string{queue, sortedQueueDeadReferenceKey(queue), sortedQueueDeadPayloadKey(queue), sortedQueueNotifyKey(queue), referenceUri},
+		serializedXSortedQueueEntry(entry, 0),
+		entry.Priority,
+		durationToMilliseconds(entry.Expiration),
+	).Int()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSortedQueueDeadLetter, err)
+	}
+	if requeued == 0 {
+		return fmt.Errorf("%w: %s not found", ErrSortedQueueDeadLetter, referenceUri)
+	}
+	return nil
+}
+
+// PurgeSortedQueueDeadLetters removes the given dead letters, or all of them if no reference URIs are provided
+func PurgeSortedQueueDeadLetters(client *RedisClient, ctx context.Context, queue string, referenceUris ...string) error {
+	var err error
+	if len(referenceUris) == 0 {
+		err = client.Del(ctx, sortedQueueDeadReferenceKey(queue), sortedQueueDeadPayloadKey(queue)).Err()
+	} else {
+		_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZRem(ctx, sortedQueueDeadReferenceKey(queue), strToInterface(referenceUris...)...)
+			pipe.HDel(ctx, sortedQueueDeadPayloadKey(queue), referenceUris...)
+			return nil
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSortedQueueDeadLetter, err)
+	}
+	return nil
+}
+
+// deadLetterSortedQueueEntry moves the entry from processing to the dead letters of its queue
+// and removes its payload, it returns ErrSortedQueueLeaseLost if the entry isn't claimed with
+// its token anymore
+func deadLetterSortedQueueEntry(client *RedisClient, consumerId string, entry XSortedQueueEntry) error {
+	failedAt := time.Now()
+	b, _ := json.Marshal(XSortedQueueDeadLetter{
+		Entry:      entry,
+		Queue:      entry.queue,
+		ConsumerId: consumerId,
+		FailedAt:   failedAt,
+	})
+	moved, err := deadLetterSortedEntryScript.Run(
+		context.Background(),
+		client,
+		[]string{
+			sortedQueueProcessingReferenceKey(entry.queue),
+			sortedQueueProcessingPriorityKey(entry.queue),
+			sortedQueueProcessingLeasesKey(entry.queue),
+			sortedQueueProcessingTokensKey(entry.queue),
+			sortedQueueDeadReferenceKey(entry.queue),
+			sortedQueueDeadPayloadKey(entry.queue),
+			sortedQueueReapsKey(entry.queue),
+			entry.ReferenceUri,
+		},
+		string(b),
+		unixMilliseconds(failedAt),
+		entry.token,
+	).Int()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSortedQueueDeadLetter, err)
+	}
+	if moved == 0 {
+		return fmt.Errorf("%w: %s", ErrSortedQueueLeaseLost, entry.ReferenceUri)
+	}
+	log.Printf("consumer '%s' moved sorted queue '%s' entry %s to dead letters after %d retries", consumerId, entry.queue, entry.ReferenceUri, entry.CurrentRetries)
+	return nil
+}
+
+// runSortedQueueDeadLetterCleaner periodically removes the dead letters older than the retention
+func runSortedQueueDeadLetterCleaner(
+	client *RedisClient,
+	shutdown context.Context,
+	consumerId string,
+	queue string,
+	failureHandler XSortedQueueFailureHandlerFunc,
+	options XSortedQueueOptions,
+) {
+	for {
+		select {
+		case <-shutdown.Done():
+			return
+		case <-time.After(options.CleanupInterval):
+			removed, err := cleanSortedEntryDeadLettersScript.Run(
+				context.Background(),
+				client,
+				[]string{sortedQueueDeadReferenceKey(queue), sortedQueueDeadPayloadKey(queue)},
+				unixMilliseconds(time.Now().Add(-options.DeadLetterRetention)),
+			).Int()
+			if err != nil {
+				failureHandler([]XFailure{{Err: fmt.Errorf("%w: failed to clean up: %v", ErrSortedQueueDeadLetter, err)}}, consumerId)
+				continue
+			}
+			if removed > 0 {
+				log.Printf("removed %d expired dead letters of sorted queue %s", removed, queue)
+			}
+		}
+	}
+}
+
+func parseSortedQueueDeadLetter(value string) (*XSortedQueueDeadLetter, error) {
+	var deadLetter XSortedQueueDeadLetter
+	if err := json.Unmarshal([]byte(value), &deadLetter); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSortedQueueDeadLetter, err)
+	}
+	if deadLetter.Entry.Failures == nil {
+		deadLetter.Entry.Failures = []string{}
+	}
+	return &deadLetter, nil
+}
@@ -4,51 +4,118 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 )
 
 func EnqueueSortedEntry(client *RedisClient, ctx context.Context, queue string, entry XSortedQueueEntry) error {
 	return enqueueSortedEntryWithPayload(client, ctx, queue, entry, 0)
 }
-func enqueueSortedEntry(client *RedisClient, ctx context.Context, queue string, referenceUri string, priority float64) error {
-	if err := client.ZAddNX(ctx, queue, &redis.Z{
-		Score:  priority,
-		Member: referenceUri,
-	}).Err(); err != nil {
-		return err
-	}
-	return nil
-}
 func enqueueSortedEntryWithPayload(client *RedisClient, ctx context.Context, queue string, entry XSortedQueueEntry, retry int) error {
-	if err := client.Set(ctx, entry.ReferenceUri, serializedXSortedQueueEntry(entry, retry), entry.Expiration).Err(); err != nil {
-		return err
-	}
-	if err := enqueueSortedEntry(client, ctx, queue, entry.ReferenceUri, entry.Priority); err != nil {
-		return err
+	now := time.Now()
+	entry.RunAt = entry.dueAt(now)
+	expiration := entry.Expiration
+	if expiration > 0 && entry.RunAt.After(now) {
+		// The expiration starts once the entry is due
+		expiration += entry.RunAt.Sub(now)
 	}
+	return enqueueSortedEntryScript.Run(
+		ctx,
+		client,
+		[]string{queue, sortedQueueScheduledReferenceKey(queue), sortedQueueScheduledPriorityKey(queue), sortedQueueNotifyKey(queue), sortedQueueReapsKey(queue), entry.ReferenceUri},
+		serializedXSortedQueueEntry(entry, retry),
+		entry.Priority,
+		durationToMilliseconds(expiration),
+		unixMilliseconds(entry.RunAt),
+	).Err()
+}
 
-	return nil
+// claimedSortedQueueEntry is an entry popped from the queue by claimSortedQueueEntries
+type claimedSortedQueueEntry struct {
+	ReferenceUri string
+	Priority     float64
+	Payload      *string // nil if the payload doesn't exist
+	Token        string  // the token the entry is claimed with
+	Reaps        int     // how many times the lease of the entry has expired since its retries were stored
 }
-func markSortedEntryForProcessing(client *RedisClient, queue string, entries ...XSortedQueueEntry) error {
-	if err := client.SAdd(context.Background(), sortedQueueProcessingReferenceKey(queue), strToInterface(getRefs(entries...)...)...).Err(); err != nil {
-		return err
+
+// claimSortedQueueEntries pops up to count entries from the queue and marks them for processing,
+// the claimed entries are leased for the visibility timeout unless it's zero. Nothing is claimed
+// if the queue is paused.
+func claimSortedQueueEntries(client *RedisClient, ctx context.Context, queue string, count int64, visibilityTimeout time.Duration) (claimed []claimedSortedQueueEntry, paused bool, err error) {
+	token := uuid.New().String()
+	v, err := claimSortedEntriesScript.Run(
+		ctx,
+		client,
+		[]string{
+			queue,
+			sortedQueueProcessingReferenceKey(queue),
+			sortedQueueProcessingPriorityKey(queue),
+			sortedQueueProcessingLeasesKey(queue),
+			sortedQueueScheduledReferenceKey(queue),
+			sortedQueueScheduledPriorityKey(queue),
+			sortedQueuePausedKey(queue),
+			sortedQueueProcessingTokensKey(queue),
+			sortedQueueNotifyKey(queue),
+			sortedQueueReapsKey(queue),
+		},
+		count,
+		leaseDeadline(visibilityTimeout),
+		unixMilliseconds(time.Now()),
+		token,
+	).Slice()
+	if err != nil {
+		return nil, false, err
 	}
-	for _, e := range entries {
-		if err := client.HSetNX(context.Background(), sortedQueueProcessingPriorityKey(queue), e.ReferenceUri, e.Priority).Err(); err != nil {
-			return err
+	if len(v) > 0 && v[0] == int64(1) {
+		return nil, true, nil
+	}
+
+	claimed = []claimedSortedQueueEntry{}
+	for i := 1; i+3 < len(v); i += 4 {
+		entry := claimedSortedQueueEntry{Token: token}
+		entry.ReferenceUri, _ = v[i].(string)
+		if priority, ok := v[i+1].(string); ok {
+			entry.Priority, _ = strconv.ParseFloat(priority, 64)
+		}
+		if payload, ok := v[i+2].(string); ok {
+			entry.Payload = &payload
 		}
+		if reaps, ok := v[i+3].(string); ok {
+			entry.Reaps, _ = strconv.Atoi(reaps)
+		}
+		claimed = append(claimed, entry)
 	}
-	return nil
+	return claimed, false, nil
 }
-func ackSortedQueueEntry(client *RedisClient, queue string, entry XSortedQueueEntry) error {
-	ctx := context.Background()
-	if err := client.SRem(ctx, sortedQueueProcessingReferenceKey(queue), strToInterface(getRefs(entry)...)...).Err(); err != nil {
-		return err
+
+// ackSortedQueueEntry removes the entries from processing, it returns ErrSortedQueueLeaseLost
+// if any of them isn't claimed with its token anymore
+func ackSortedQueueEntry(client *RedisClient, queue string, entries ...XSortedQueueEntry) error {
+	args := []interface{}{}
+	for _, e := range entries {
+		args = append(args, e.ReferenceUri, e.token)
 	}
-	if err := client.HDel(ctx, sortedQueueProcessingPriorityKey(queue), getRefs(entry)...).Err(); err != nil {
+	acked, err := ackSortedEntriesScript.Run(
+		context.Background(),
+		client,
+		[]string{
+			sortedQueueProcessingReferenceKey(queue),
+			sortedQueueProcessingPriorityKey(queue),
+			sortedQueueProcessingLeasesKey(queue),
+			sortedQueueProcessingTokensKey(queue),
+		},
+		args...,
+	).Int()
+	if err != nil {
 		return err
 	}
+	if acked < len(entries) {
+		return fmt.Errorf("%w: %s", ErrSortedQueueLeaseLost, strings.Join(getRefs(entries...), ", "))
+	}
 	return nil
 }
 func getRefs(entries ...XSortedQueueEntry) []string {
@@ -66,38 +133,145 @@ func strToInterface(v ...string) []interface{} {
 	return i
 }
 
+// cleanSortedQueueEntry removes the entry from processing along with its payload, it returns
+// ErrSortedQueueLeaseLost if the entry isn't claimed with its token anymore
 func cleanSortedQueueEntry(client *RedisClient, e XSortedQueueEntry) error {
-	ctx := context.Background()
-	if err := client.SRem(ctx, sortedQueueProcessingReferenceKey(e.queue), strToInterface(e.ReferenceUri)[0]).Err(); err != nil {
-		return fmt.Errorf("failed to clean up processing reference of sorted queue entry %s: %v", e.ReferenceUri, err)
+	cleaned, err := cleanSortedEntryScript.Run(
+		context.Background(),
+		client,
+		[]string{
+			e.queue,
+			sortedQueueProcessingReferenceKey(e.queue),
+			sortedQueueProcessingPriorityKey(e.queue),
+			sortedQueueProcessingLeasesKey(e.queue),
+			sortedQueueProcessingTokensKey(e.queue),
+			sortedQueueScheduledReferenceKey(e.queue),
+			sortedQueueReapsKey(e.queue),
+			e.ReferenceUri,
+		},
+		e.token,
+	).Int()
+	if err != nil {
+		return fmt.Errorf("failed to clean up sorted queue entry %s: %v", e.ReferenceUri, err)
 	}
-	if err := client.HDel(ctx, sortedQueueProcessingPriorityKey(e.queue), e.ReferenceUri).Err(); err != nil {
-		return fmt.Errorf("failed to clean up processing priority of sorted queue entry %s: %v", e.ReferenceUri, err)
+	if cleaned == 0 {
+		return fmt.Errorf("%w: %s", ErrSortedQueueLeaseLost, e.ReferenceUri)
 	}
-	if err := client.Del(ctx, e.ReferenceUri).Err(); err != nil {
-		return fmt.Errorf("failed to clean up sorted queue entry %s: %v", e.ReferenceUri, err)
+	return nil
+}
+
+// retrySortedQueueEntryWithPayload queues the entry again after the delay, or right away if it's zero.
+// It returns ErrSortedQueueLeaseLost if the entry isn't claimed with its token anymore.
+func retrySortedQueueEntryWithPayload(client *RedisClient, e XSortedQueueEntry, retry int, delay time.Duration) error {
+	expiration := e.Expiration
+	e.RunAt = time.Time{}
+	if delay > 0 {
+		e.RunAt = time.Now().Add(delay)
+		if expiration > 0 {
+			// The expiration starts once the entry is due
+			expiration += delay
+		}
+	}
+	retried, err := retrySortedEntryScript.Run(
+		context.Background(),
+		client,
+		[]string{
+			e.queue,
+			sortedQueueProcessingReferenceKey(e.queue),
+			sortedQueueProcessingPriorityKey(e.queue),
+			sortedQueueProcessingLeasesKey(e.queue),
+			sortedQueueScheduledReferenceKey(e.queue),
+			sortedQueueScheduledPriorityKey(e.queue),
+			sortedQueueProcessingTokensKey(e.queue),
+			sortedQueueNotifyKey(e.queue),
+			sortedQueueReapsKey(e.queue),
+			e.ReferenceUri,
+		},
+		serializedXSortedQueueEntry(e, retry),
+		e.Priority,
+		durationToMilliseconds(expiration),
+		unixMilliseconds(e.RunAt),
+		e.token,
+	).Int()
+	if err != nil {
+		return err
+	}
+	if retried == 0 {
+		return fmt.Errorf("%w: %s", ErrSortedQueueLeaseLost, e.ReferenceUri)
 	}
 	return nil
 }
 
-func getXSortedQueueEntryByUri(client *RedisClient, uri interface{}) (string, error) {
-	_uri, ok := uri.(string)
-	if !ok {
-		return "", nil
+func reviveSortedQueueEntries(client *RedisClient, ctx context.Context, queue string) (int, error) {
+	return reviveSortedEntriesScript.Run(
+		ctx,
+		client,
+		[]string{
+			queue,
+			sortedQueueProcessingReferenceKey(queue),
+			sortedQueueProcessingPriorityKey(queue),
+			sortedQueueProcessingLeasesKey(queue),
+			sortedQueueProcessingTokensKey(queue),
+			sortedQueueNotifyKey(queue),
+		},
+	).Int()
+}
+
+// extendSortedQueueEntryLease moves the lease deadline of the entry to d from now
+func extendSortedQueueEntryLease(client *RedisClient, e XSortedQueueEntry, d time.Duration) error {
+	extended, err := extendSortedEntryLeaseScript.Run(
+		context.Background(),
+		client,
+		[]string{sortedQueueProcessingLeasesKey(e.queue), sortedQueueProcessingTokensKey(e.queue), e.ReferenceUri},
+		leaseDeadline(d),
+		e.token,
+	).Int()
+	if err != nil {
+		return fmt.Errorf("failed to extend sorted queue entry %s: %v", e.ReferenceUri, err)
 	}
+	if extended == 0 {
+		return fmt.Errorf("%w: %s", ErrSortedQueueLeaseLost, e.ReferenceUri)
+	}
+	return nil
+}
+
+// reapSortedQueueEntries requeues up to count processing entries with an expired lease
+func reapSortedQueueEntries(client *RedisClient, ctx context.Context, queue string, count int64) (int, error) {
+	return reapSortedEntriesScript.Run(
+		ctx,
+		client,
+		[]string{
+			queue,
+			sortedQueueProcessingReferenceKey(queue),
+			sortedQueueProcessingPriorityKey(queue),
+			sortedQueueProcessingLeasesKey(queue),
+			sortedQueueProcessingTokensKey(queue),
+			sortedQueueNotifyKey(queue),
+			sortedQueueReapsKey(queue),
+		},
+		unixMilliseconds(time.Now()),
+		count,
+	).Int()
+}
+
+func durationToMilliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
 
-	if !IsValidUri(_uri) {
-		return "", fmt.Errorf("invalid URI: %v", uri)
+// leaseDeadline returns the unix milliseconds d from now, or zero if d is zero
+func leaseDeadline(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
 	}
+	return unixMilliseconds(time.Now().Add(d))
+}
 
-	v, err := client.Get(context.Background(), _uri).Result()
-	if err != nil {
-		if err == redis.Nil {
-			err = fmt.Errorf("failed to read from URI %v", uri)
-		}
-		return "", err
+// unixMilliseconds returns the unix milliseconds of t, or zero if t is zero
+func unixMilliseconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
 	}
-	return v, nil
+	return t.UnixNano() / int64(time.Millisecond)
 }
 
 func parseXSortedQueueEntry(i string) (*XSortedQueueEntry, error) {
@@ -108,11 +282,16 @@ func parseXSortedQueueEntry(i string) (*XSortedQueueEntry, error) {
 	if e.Failures == nil {
 		e.Failures = make([]string, 0)
 	}
-	return &XSortedQueueEntry{
+	entry := &XSortedQueueEntry{
 		CurrentRetries: e.Retries,
 		Value:          e.Value,
 		Priority:       e.Priority,
 		ReferenceUri:   e.ReferenceUri,
+		Expiration:     e.Expiration,
 		Failures:       e.Failures,
-	}, nil
+	}
+	if e.RunAt != nil {
+		entry.RunAt = *e.RunAt
+	}
+	return entry, nil
 }
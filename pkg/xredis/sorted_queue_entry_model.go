@@ -9,10 +9,12 @@ type XSortedQueueEntry struct {
 	// Internal use only
 	c *RedisClient `json:"-"`
 
-	retry          bool   `json:"-"`
-	maxRetries     int    `json:"-"`
-	currentFailure error  `json:"-"`
-	queue          string `json:"-"`
+	retry          bool          `json:"-"`
+	maxRetries     int           `json:"-"`
+	timeout        time.Duration `json:"-"`
+	currentFailure error         `json:"-"`
+	queue          string        `json:"-"`
+	token          string        `json:"-"` // the token the entry is claimed with
 
 	Value          string        `json:"value,omitempty"`
 	Priority       float64       `json:"priority"`
@@ -20,6 +22,11 @@ type XSortedQueueEntry struct {
 	Expiration     time.Duration `json:"expiration"`
 	Failures       []string      `json:"failures,omitempty"`
 	CurrentRetries int           `json:"currentRetries"`
+	// RunAt schedules the entry, it's not visible to the consumers until then. The due entries
+	// are consumed in the order of their priority along with the rest of the queue.
+	RunAt time.Time `json:"runAt"`
+	// Delay schedules the entry to run after the delay from when it's enqueued, it's ignored if RunAt is set
+	Delay time.Duration `json:"-"`
 }
 type internalPersistedXSortedQueueEntry struct {
 	Retries      int           `json:"retries"`
@@ -27,6 +34,7 @@ type internalPersistedXSortedQueueEntry struct {
 	Priority     float64       `json:"priority"`
 	ReferenceUri string        `json:"referenceUri"`
 	Expiration   time.Duration `json:"expiration"`
+	RunAt        *time.Time    `json:"runAt,omitempty"` // nil if the entry was due when it's queued
 	Failures     []string      `json:"failures,omitempty"`
 }
 
@@ -40,24 +48,53 @@ func NewXSortedQueueEntry(value string, priority float64, referenceUri string, e
 	}
 }
 
+// NewXSortedQueueEntryWithValue encodes the value with the codec into a new entry
+func NewXSortedQueueEntryWithValue(codec Codec, value interface{}, priority float64, referenceUri string, expiration time.Duration) (XSortedQueueEntry, error) {
+	encoded, err := EncodeValue(codec, value)
+	if err != nil {
+		return XSortedQueueEntry{}, err
+	}
+	return NewXSortedQueueEntry(encoded, priority, referenceUri, expiration), nil
+}
+
 func serializedXSortedQueueEntry(i XSortedQueueEntry, try int) string {
-	b, _ := json.Marshal(internalPersistedXSortedQueueEntry{
+	e := internalPersistedXSortedQueueEntry{
 		Retries:      try,
 		Value:        i.Value,
 		Priority:     i.Priority,
 		ReferenceUri: i.ReferenceUri,
 		Expiration:   i.Expiration,
 		Failures:     i.Failures,
-	})
+	}
+	if !i.RunAt.IsZero() {
+		e.RunAt = &i.RunAt
+	}
+	b, _ := json.Marshal(e)
 
 	return string(b)
 }
 
+// dueAt returns when the entry is due, it's zero if the entry is due right away
+func (x *XSortedQueueEntry) dueAt(now time.Time) time.Time {
+	if !x.RunAt.IsZero() {
+		return x.RunAt
+	}
+	if x.Delay > 0 {
+		return now.Add(x.Delay)
+	}
+	return time.Time{}
+}
+
 func (x *XSortedQueueEntry) String() string {
 	b, _ := json.Marshal(x)
 	return string(b)
 }
 
+// DecodeValue decodes the value of the entry with the codec into v
+func (x *XSortedQueueEntry) DecodeValue(codec Codec, v interface{}) error {
+	return DecodeValue(codec, x.Value, v)
+}
+
 func (x *XSortedQueueEntry) IsLastRetry() bool {
 	return x.CurrentRetries >= x.maxRetries
 }
@@ -81,6 +118,13 @@ func (x *XSortedQueueEntry) Ack() error {
 	return nil
 }
 
+// Extend keeps the entry leased to its consumer for d from now, long running jobs should
+// extend their entries periodically before the visibility timeout expires. It returns
+// ErrSortedQueueLeaseLost if the lease has already expired and the entry is queued or claimed again.
+func (x *XSortedQueueEntry) Extend(d time.Duration) error {
+	return extendSortedQueueEntryLease(x.c, *x, d)
+}
+
 func (x *XSortedQueueEntry) CleanUp() error {
 	if err := cleanSortedQueueEntry(x.c, *x); err != nil {
 		x.setFailure(err)
@@ -1,16 +1,83 @@
 package xredis
 
+import "time"
+
+const defaultSortedQueueVisibilityTimeout = time.Minute * 5
+const defaultSortedQueueBlockTimeout = time.Second
+const sortedQueuePollInterval = time.Millisecond * 100
+const defaultSortedQueueDeadLetterRetention = time.Hour * 24 * 7
+const defaultSortedQueueCleanupInterval = time.Minute
+const defaultSortedQueueScaleInterval = time.Second * 5
+const defaultSortedQueueTargetLatency = time.Second
+const defaultSortedQueueScaleDownIdleRatio = 0.5
+
 type XSortedQueueOptions struct {
 	MaxRetries int
 	Consuming  int64
-	Consumers  int
+	// Consumers is the amount of the consumers, or the initial amount when autoscaling
+	Consumers int
+	// MinConsumers and MaxConsumers enable autoscaling when MaxConsumers is greater than
+	// MinConsumers, the consumers are added and removed one at a time between the two
+	MinConsumers int
+	MaxConsumers int
+	// ScaleInterval is how often the consumers are scaled, defaults to 5s
+	ScaleInterval time.Duration
+	// TargetLatency is how long the entries may wait in the queue, based on the queue depth
+	// and the processing latency, before a consumer is added. Defaults to 1s.
+	TargetLatency time.Duration
+	// ScaleDownIdleRatio is the ratio of the claims that find nothing to claim
+	// above which a consumer is removed, defaults to 0.5
+	ScaleDownIdleRatio float64
+	// ConsumerPrefix is the prefix of the consumer ids, defaults to the queue name
+	ConsumerPrefix string
+	// VisibilityTimeout is how long a claimed entry is leased to its consumer, entries that
+	// aren't done or extended by then are queued again by the reaper. Defaults to 5 minutes,
+	// a negative timeout disables leases.
+	VisibilityTimeout time.Duration
+	// ReapInterval is how often the expired leases are checked, defaults to half of VisibilityTimeout
+	ReapInterval time.Duration
+	// Blocking makes the consumers wait for the entries to be queued instead of polling
+	// the queue every 100ms. Instead of BZPOPMIN, which would pop the entries outside of the
+	// claim script, the consumers block with BLPOP on the notifications of the queue and claim
+	// the entries once they're woken up. It works the same on any Redis version, so there's
+	// no fallback to polling. The notifications are pushed by the functions of this package
+	// that queue the entries, the entries added to the queue by other producers directly
+	// are only claimed once a consumer wakes up after BlockTimeout.
+	Blocking bool
+	// BlockTimeout is how long a consumer blocks before checking for shutdown, defaults to 1s.
+	// It's also the longest a scheduled entry might wait after it's due while blocking.
+	BlockTimeout time.Duration
+	// BatchTimeout is how long the consumer may take to process a batch, the entries that
+	// aren't done by then are retried with ErrSortedQueueTimeout. Zero disables it.
+	BatchTimeout time.Duration
+	// EntryTimeout is how long each entry may take, a batch may take EntryTimeout times its
+	// size at most, capped by BatchTimeout. NewSortedQueueEntryHandler applies it to every entry.
+	EntryTimeout time.Duration
+	// RetryPolicy decides the priority and the delay of the failed entries, defaults to DefaultRetryPolicy
+	RetryPolicy RetryPolicy
+	// DeadLetterRetention is how long the dead letters are kept, defaults to 7 days.
+	// A negative retention keeps them forever.
+	DeadLetterRetention time.Duration
+	// CleanupInterval is how often the expired dead letters are removed, defaults to 1 minute
+	CleanupInterval time.Duration
+	// Controller pauses, resumes and drains the consumers, it's optional
+	Controller *SortedQueueController
+	// OnConsumersChange is called with the amount of the running consumers whenever a consumer
+	// starts or stops, e.g. to monitor the autoscaled consumers. It's optional.
+	OnConsumersChange func(consumers int)
 }
 
 func NewXSortedQueueOptions() *XSortedQueueOptions {
 	return &XSortedQueueOptions{
-		MaxRetries: 3,
-		Consuming:  10,
-		Consumers:  1,
+		MaxRetries:          3,
+		Consuming:           10,
+		Consumers:           1,
+		VisibilityTimeout:   defaultSortedQueueVisibilityTimeout,
+		ReapInterval:        defaultSortedQueueVisibilityTimeout / 2,
+		BlockTimeout:        defaultSortedQueueBlockTimeout,
+		RetryPolicy:         DefaultRetryPolicy,
+		DeadLetterRetention: defaultSortedQueueDeadLetterRetention,
+		CleanupInterval:     defaultSortedQueueCleanupInterval,
 	}
 }
 
@@ -21,4 +88,57 @@ func (x *XSortedQueueOptions) Initialize() {
 	if x.Consumers < 1 {
 		x.Consumers = 1
 	}
+	if x.isAutoscaling() {
+		if x.MinConsumers < 1 {
+			x.MinConsumers = 1
+		}
+		if x.Consumers < x.MinConsumers {
+			x.Consumers = x.MinConsumers
+		}
+		if x.Consumers > x.MaxConsumers {
+			x.Consumers = x.MaxConsumers
+		}
+		if x.ScaleInterval <= 0 {
+			x.ScaleInterval = defaultSortedQueueScaleInterval
+		}
+		if x.TargetLatency <= 0 {
+			x.TargetLatency = defaultSortedQueueTargetLatency
+		}
+		if x.ScaleDownIdleRatio <= 0 {
+			x.ScaleDownIdleRatio = defaultSortedQueueScaleDownIdleRatio
+		}
+	}
+	if x.VisibilityTimeout == 0 {
+		x.VisibilityTimeout = defaultSortedQueueVisibilityTimeout
+	}
+	if x.VisibilityTimeout > 0 && x.ReapInterval <= 0 {
+		x.ReapInterval = x.VisibilityTimeout / 2
+	}
+	if x.BlockTimeout <= 0 {
+		x.BlockTimeout = defaultSortedQueueBlockTimeout
+	}
+	if x.RetryPolicy == nil {
+		x.RetryPolicy = DefaultRetryPolicy
+	}
+	if x.DeadLetterRetention == 0 {
+		x.DeadLetterRetention = defaultSortedQueueDeadLetterRetention
+	}
+	if x.DeadLetterRetention > 0 && x.CleanupInterval <= 0 {
+		x.CleanupInterval = defaultSortedQueueCleanupInterval
+	}
+}
+
+// batchTimeout returns how long a batch of size entries may take, zero if it's unlimited
+func (x *XSortedQueueOptions) batchTimeout(size int) time.Duration {
+	timeout := x.BatchTimeout
+	if x.EntryTimeout > 0 {
+		if t := x.EntryTimeout * time.Duration(size); timeout <= 0 || t < timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+func (x *XSortedQueueOptions) isAutoscaling() bool {
+	return x.MaxConsumers > 0 && x.MaxConsumers > x.MinConsumers
 }
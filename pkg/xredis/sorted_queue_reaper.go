@@ -0,0 +1,50 @@
+package xredis
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// sortedQueueReapBatch is the amount of expired leases requeued per script call
+const sortedQueueReapBatch = 100
+
+// runSortedQueueReaper periodically queues the entries with an expired lease again,
+// so the entries of a hung or crashed consumer are picked up by the other consumers
+func runSortedQueueReaper(
+	client *RedisClient,
+	shutdown context.Context,
+	consumerId string,
+	queue string,
+	failureHandler XSortedQueueFailureHandlerFunc,
+	options XSortedQueueOptions,
+) {
+	for {
+		select {
+		case <-shutdown.Done():
+			return
+		case <-time.After(options.ReapInterval):
+			internalReapSortedQueue(client, consumerId, queue, failureHandler)
+		}
+	}
+}
+
+func internalReapSortedQueue(client *RedisClient, consumerId string, queue string, failureHandler XSortedQueueFailureHandlerFunc) {
+	requeued := 0
+	for {
+		// The Background context makes sure a batch is never cancelled half way
+		n, err := reapSortedQueueEntries(client, context.Background(), queue, sortedQueueReapBatch)
+		if err != nil {
+			failureHandler([]XFailure{{Err: fmt.Errorf("failed to reap expired leases: %v", err)}}, consumerId)
+			break
+		}
+		requeued += n
+		if n < sortedQueueReapBatch {
+			break
+		}
+	}
+	if requeued > 0 {
+		log.Printf("requeued %d entries with expired leases of sorted queue %s", requeued, queue)
+	}
+}
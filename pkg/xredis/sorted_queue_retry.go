@@ -0,0 +1,51 @@
+package xredis
+
+import "time"
+
+// RetryPolicy decides the new priority of a failed sorted queue entry and how long
+// to wait before it's visible to the consumers again. The entry is passed as it failed,
+// so its CurrentRetries is the amount of the retries before this one.
+type RetryPolicy interface {
+	Next(entry XSortedQueueEntry) (priority float64, delay time.Duration)
+}
+
+// RetryPolicyFunc lets an ordinary function be used as a RetryPolicy
+type RetryPolicyFunc func(entry XSortedQueueEntry) (priority float64, delay time.Duration)
+
+func (f RetryPolicyFunc) Next(entry XSortedQueueEntry) (float64, time.Duration) {
+	return f(entry)
+}
+
+// DefaultRetryPolicy retries the entries right away with 10% lower priority,
+// higher numbers have lower priority
+var DefaultRetryPolicy RetryPolicy = RetryPolicyFunc(func(entry XSortedQueueEntry) (float64, time.Duration) {
+	return entry.Priority * 1.1, 0
+})
+
+// BackoffRetryPolicy keeps the priority of the entries and delays each retry by the backoff
+func BackoffRetryPolicy(backoff Backoff) RetryPolicy {
+	return RetryPolicyFunc(func(entry XSortedQueueEntry) (float64, time.Duration) {
+		return entry.Priority, backoff.Delay(entry.CurrentRetries + 1)
+	})
+}
+
+// ConstantRetryPolicy delays every retry by the same delay
+func ConstantRetryPolicy(delay time.Duration) RetryPolicy {
+	return BackoffRetryPolicy(FixedBackoff(delay))
+}
+
+// LinearRetryPolicy grows the delay by step on every retry, up to max
+func LinearRetryPolicy(step time.Duration, max time.Duration) RetryPolicy {
+	return BackoffRetryPolicy(LinearBackoff(step, max))
+}
+
+// ExponentialRetryPolicy doubles the delay on every retry starting from base, up to max
+func ExponentialRetryPolicy(base time.Duration, max time.Duration) RetryPolicy {
+	return BackoffRetryPolicy(ExponentialBackoff(base, max))
+}
+
+// JitteredRetryPolicy works like ExponentialRetryPolicy but randomizes the delays,
+// so entries failed together don't all come back at the same time
+func JitteredRetryPolicy(base time.Duration, max time.Duration) RetryPolicy {
+	return BackoffRetryPolicy(ExponentialJitterBackoff(base, max))
+}
@@ -0,0 +1,147 @@
+package xredis
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sortedQueueMetrics collects what the consumers do between two scaling decisions
+type sortedQueueMetrics struct {
+	claims     int64 // claim attempts
+	idleClaims int64 // claim attempts that found nothing to claim
+	batches    int64 // processed batches
+	batchNanos int64 // time spent processing the batches
+}
+
+func (m *sortedQueueMetrics) recordClaim(claimed int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.claims, 1)
+	if claimed == 0 {
+		atomic.AddInt64(&m.idleClaims, 1)
+	}
+}
+
+func (m *sortedQueueMetrics) recordBatch(d time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.batches, 1)
+	atomic.AddInt64(&m.batchNanos, int64(d))
+}
+
+// collect returns the idle ratio and the average batch latency since the last collect,
+// the latency is zero if no batch has been processed
+func (m *sortedQueueMetrics) collect() (idleRatio float64, latency time.Duration) {
+	claims := atomic.SwapInt64(&m.claims, 0)
+	idleClaims := atomic.SwapInt64(&m.idleClaims, 0)
+	batches := atomic.SwapInt64(&m.batches, 0)
+	batchNanos := atomic.SwapInt64(&m.batchNanos, 0)
+	if claims > 0 {
+		idleRatio = float64(idleClaims) / float64(claims)
+	}
+	if batches > 0 {
+		latency = time.Duration(batchNanos / batches)
+	}
+	return idleRatio, latency
+}
+
+// sortedQueueScaler adds and removes consumers between MinConsumers and MaxConsumers
+type sortedQueueScaler struct {
+	client  *RedisClient
+	queue   string
+	options XSortedQueueOptions
+	metrics *sortedQueueMetrics
+	// start runs a new consumer until the stop channel is closed
+	start func(consumerId string, stop chan struct{})
+
+	m           sync.Mutex
+	stops       []chan struct{}
+	lastLatency time.Duration
+}
+
+func newSortedQueueScaler(client *RedisClient, queue string, options XSortedQueueOptions, start func(consumerId string, stop chan struct{})) *sortedQueueScaler {
+	return &sortedQueueScaler{
+		client:  client,
+		queue:   queue,
+		options: options,
+		metrics: &sortedQueueMetrics{},
+		start:   start,
+	}
+}
+
+// scaleTo starts or stops consumers until there are n of them
+func (s *sortedQueueScaler) scaleTo(n int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for len(s.stops) < n {
+		stop := make(chan struct{})
+		s.stops = append(s.stops, stop)
+		s.start(ConsumerId(s.options.ConsumerPrefix, len(s.stops)), stop)
+	}
+	for len(s.stops) > n {
+		last := len(s.stops) - 1
+		close(s.stops[last])
+		s.stops = s.stops[:last]
+	}
+}
+
+func (s *sortedQueueScaler) consumers() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.stops)
+}
+
+// run periodically scales the consumers until shutdown
+func (s *sortedQueueScaler) run(shutdown context.Context) {
+	for {
+		select {
+		case <-shutdown.Done():
+			// The consumers stop by themselves on shutdown
+			return
+		case <-time.After(s.options.ScaleInterval):
+			depth, err := s.client.ZCard(context.Background(), s.queue).Result()
+			if err != nil {
+				log.Printf("failed to read the depth of sorted queue %s: %v", s.queue, err)
+				continue
+			}
+			current := s.consumers()
+			idleRatio, latency := s.metrics.collect()
+			if next := s.next(current, depth, idleRatio, latency); next != current {
+				log.Printf("scaling sorted queue %s consumers from %d to %d (depth %d, idle ratio %.2f, latency %s)", s.queue, current, next, depth, idleRatio, latency)
+				s.scaleTo(next)
+			}
+		}
+	}
+}
+
+// next decides the amount of the consumers, one step at a time. It scales up when
+// the entries are expected to wait in the queue longer than TargetLatency, and down
+// when the consumers find nothing to claim more often than ScaleDownIdleRatio.
+func (s *sortedQueueScaler) next(current int, depth int64, idleRatio float64, latency time.Duration) int {
+	if latency > 0 {
+		s.lastLatency = latency
+	} else if depth > 0 && s.lastLatency < s.options.ScaleInterval {
+		// No batch has finished during the interval, they take at least as long
+		latency = s.options.ScaleInterval
+	} else {
+		latency = s.lastLatency
+	}
+
+	if depth > 0 && current < s.options.MaxConsumers {
+		// Each consumer clears a batch of entries per latency
+		batches := float64(depth) / float64(s.options.Consuming*int64(current))
+		if time.Duration(batches*float64(latency)) > s.options.TargetLatency {
+			return current + 1
+		}
+	}
+	if idleRatio > s.options.ScaleDownIdleRatio && current > s.options.MinConsumers {
+		return current - 1
+	}
+	return current
+}
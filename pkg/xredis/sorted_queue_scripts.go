@@ -0,0 +1,343 @@
+package xredis
+
+import "github.com/go-redis/redis/v8"
+
+// The scripts below move the sorted queue entries between their states atomically,
+// so an entry is always either queued, processing or done and never orphaned in between.
+// Each claim stores its own token for the claimed entries, the scripts changing a processing
+// entry on behalf of its consumer only do so if the token still matches. An entry reaped and
+// claimed again by another consumer can't be acked, retried or cleaned up by the late one.
+// The expired leases of an entry are counted as its failed attempts, the claim script returns
+// the count so an entry that always hangs its consumer eventually exhausts its retries. The
+// count is dropped once the retries are stored in the payload or the entry is gone.
+// The scripts queueing an entry push a notification to wake up a blocking consumer, the
+// notifications are capped at 100 since each of them wakes up a consumer that claims a batch.
+// Note: the claim and revive scripts access the payload keys by the references they
+// read from the queue, therefore they are not compatible with Redis Cluster.
+
+// enqueueSortedEntryScript stores the payload and adds its reference to the queue, or to the
+// scheduled entries if it's due in the future
+//
+// KEYS: queue, scheduled references, scheduled priorities, notifications, reaps, referenceUri
+// ARGV: payload, priority, expiration in milliseconds (zero never expires), due in unix milliseconds (zero is due now)
+var enqueueSortedEntryScript = redis.NewScript(`
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[6], ARGV[1], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[6], ARGV[1])
+end
+redis.call('HDEL', KEYS[5], KEYS[6])
+if tonumber(ARGV[4]) > 0 then
+	redis.call('HSET', KEYS[3], KEYS[6], ARGV[2])
+	return redis.call('ZADD', KEYS[2], 'NX', ARGV[4], KEYS[6])
+end
+local added = redis.call('ZADD', KEYS[1], 'NX', ARGV[2], KEYS[6])
+redis.call('LPUSH', KEYS[4], 1)
+redis.call('LTRIM', KEYS[4], 0, 99)
+return added
+`)
+
+// claimSortedEntriesScript moves the due scheduled entries to the queue, then pops the entries
+// with the highest priority and marks the ones with a payload for processing, leasing them
+// until the given deadline under the claim token. It returns the reference, priority, payload
+// and expired leases of each popped entry, the payload is nil if it doesn't exist anymore. The notifications
+// are dropped once the queue is empty, so they don't wake up the consumers for nothing. The first
+// element of the result is 1 if the queue is paused, in that case nothing is claimed.
+//
+// KEYS: queue, processing references, processing priorities, processing leases, scheduled references, scheduled priorities, paused, processing tokens, notifications, reaps
+// ARGV: count, lease deadline in unix milliseconds (zero never expires), now in unix milliseconds, claim token
+var claimSortedEntriesScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[7]) == 1 then
+	return {1}
+end
+local due = redis.call('ZRANGEBYSCORE', KEYS[5], '-inf', ARGV[3], 'LIMIT', 0, 100)
+for _, ref in ipairs(due) do
+	local priority = redis.call('HGET', KEYS[6], ref)
+	if not priority then
+		priority = 0
+	end
+	redis.call('ZADD', KEYS[1], 'NX', priority, ref)
+	redis.call('ZREM', KEYS[5], ref)
+	redis.call('HDEL', KEYS[6], ref)
+end
+local popped = redis.call('ZPOPMIN', KEYS[1], ARGV[1])
+if redis.call('ZCARD', KEYS[1]) == 0 then
+	redis.call('DEL', KEYS[9])
+end
+local claimed = {0}
+for i = 1, #popped, 2 do
+	local ref = popped[i]
+	local priority = popped[i + 1]
+	local payload = false
+	if string.sub(ref, 1, 6) == 'gid://' then
+		payload = redis.call('GET', ref)
+	end
+	if payload then
+		redis.call('SADD', KEYS[2], ref)
+		redis.call('HSET', KEYS[3], ref, priority)
+		redis.call('HSET', KEYS[8], ref, ARGV[4])
+		if tonumber(ARGV[2]) > 0 then
+			redis.call('ZADD', KEYS[4], ARGV[2], ref)
+		end
+	end
+	table.insert(claimed, ref)
+	table.insert(claimed, priority)
+	table.insert(claimed, payload)
+	table.insert(claimed, redis.call('HGET', KEYS[10], ref) or '0')
+end
+return claimed
+`)
+
+// ackSortedEntriesScript removes the entries still claimed with their tokens from processing,
+// and returns the amount of the acked entries
+//
+// KEYS: processing references, processing priorities, processing leases, processing tokens
+// ARGV: referenceUri, claim token, ...
+var ackSortedEntriesScript = redis.NewScript(`
+local acked = 0
+for i = 1, #ARGV, 2 do
+	local ref = ARGV[i]
+	if redis.call('HGET', KEYS[4], ref) == ARGV[i + 1] then
+		redis.call('SREM', KEYS[1], ref)
+		redis.call('HDEL', KEYS[2], ref)
+		redis.call('ZREM', KEYS[3], ref)
+		redis.call('HDEL', KEYS[4], ref)
+		acked = acked + 1
+	end
+end
+return acked
+`)
+
+// cleanSortedEntryScript removes the entry from processing along with its payload, or only
+// the payload if the entry has been acked already. It returns zero if the entry is claimed
+// with another token, or it's been queued again since its lease expired.
+//
+// KEYS: queue, processing references, processing priorities, processing leases, processing tokens, scheduled references, reaps, referenceUri
+// ARGV: claim token
+var cleanSortedEntryScript = redis.NewScript(`
+local token = redis.call('HGET', KEYS[5], KEYS[8])
+if token then
+	if token ~= ARGV[1] then
+		return 0
+	end
+	redis.call('SREM', KEYS[2], KEYS[8])
+	redis.call('HDEL', KEYS[3], KEYS[8])
+	redis.call('ZREM', KEYS[4], KEYS[8])
+	redis.call('HDEL', KEYS[5], KEYS[8])
+elseif redis.call('SISMEMBER', KEYS[2], KEYS[8]) == 1 or redis.call('ZSCORE', KEYS[1], KEYS[8]) or redis.call('ZSCORE', KEYS[6], KEYS[8]) then
+	return 0
+end
+redis.call('HDEL', KEYS[7], KEYS[8])
+redis.call('DEL', KEYS[8])
+return 1
+`)
+
+// retrySortedEntryScript stores the updated payload, adds the entry back to the queue with
+// its new priority, or to the scheduled entries if it's delayed, and removes it from processing.
+// It returns zero if the entry isn't claimed with the token anymore.
+//
+// KEYS: queue, processing references, processing priorities, processing leases, scheduled references, scheduled priorities, processing tokens, notifications, reaps, referenceUri
+// ARGV: payload, priority, expiration in milliseconds (zero never expires), due in unix milliseconds (zero is due now), claim token
+var retrySortedEntryScript = redis.NewScript(`
+if redis.call('HGET', KEYS[7], KEYS[10]) ~= ARGV[5] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[10], ARGV[1], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[10], ARGV[1])
+end
+if tonumber(ARGV[4]) > 0 then
+	redis.call('HSET', KEYS[6], KEYS[10], ARGV[2])
+	redis.call('ZADD', KEYS[5], ARGV[4], KEYS[10])
+else
+	redis.call('ZADD', KEYS[1], ARGV[2], KEYS[10])
+	redis.call('LPUSH', KEYS[8], 1)
+	redis.call('LTRIM', KEYS[8], 0, 99)
+end
+redis.call('SREM', KEYS[2], KEYS[10])
+redis.call('HDEL', KEYS[3], KEYS[10])
+redis.call('ZREM', KEYS[4], KEYS[10])
+redis.call('HDEL', KEYS[7], KEYS[10])
+redis.call('HDEL', KEYS[9], KEYS[10])
+return 1
+`)
+
+// reviveSortedEntriesScript moves the processing entries without a lease back to the queue
+// with their priority at the time they were claimed, and returns the amount of the revived
+// entries. The leased entries are left to the reaper as their consumers might still be alive.
+//
+// KEYS: queue, processing references, processing priorities, processing leases, processing tokens, notifications
+var reviveSortedEntriesScript = redis.NewScript(`
+local refs = redis.call('SMEMBERS', KEYS[2])
+local revived = 0
+for _, ref in ipairs(refs) do
+	if not redis.call('ZSCORE', KEYS[4], ref) then
+		local priority = redis.call('HGET', KEYS[3], ref)
+		if not priority then
+			priority = 0
+		end
+		redis.call('ZADD', KEYS[1], 'NX', priority, ref)
+		redis.call('SREM', KEYS[2], ref)
+		redis.call('HDEL', KEYS[3], ref)
+		redis.call('HDEL', KEYS[5], ref)
+		revived = revived + 1
+	end
+end
+if revived > 0 then
+	redis.call('LPUSH', KEYS[6], 1)
+	redis.call('LTRIM', KEYS[6], 0, 99)
+end
+return revived
+`)
+
+// extendSortedEntryLeaseScript moves the lease deadline of a processing entry, it returns
+// zero if the entry isn't claimed with the token anymore
+//
+// KEYS: processing leases, processing tokens, referenceUri
+// ARGV: lease deadline in unix milliseconds, claim token
+var extendSortedEntryLeaseScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], KEYS[3]) ~= ARGV[2] then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[1], KEYS[3])
+return 1
+`)
+
+// reapSortedEntriesScript moves the processing entries with an expired lease back to
+// the queue with their priority at the time they were claimed, counting the expired
+// lease of each of them, and returns the amount of the requeued entries
+//
+// KEYS: queue, processing references, processing priorities, processing leases, processing tokens, notifications, reaps
+// ARGV: now in unix milliseconds, count
+var reapSortedEntriesScript = redis.NewScript(`
+local refs = redis.call('ZRANGEBYSCORE', KEYS[4], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+local requeued = 0
+for _, ref in ipairs(refs) do
+	if redis.call('SREM', KEYS[2], ref) == 1 then
+		local priority = redis.call('HGET', KEYS[3], ref)
+		if not priority then
+			priority = 0
+		end
+		redis.call('ZADD', KEYS[1], 'NX', priority, ref)
+		redis.call('HINCRBY', KEYS[7], ref, 1)
+		requeued = requeued + 1
+	end
+	redis.call('HDEL', KEYS[3], ref)
+	redis.call('ZREM', KEYS[4], ref)
+	redis.call('HDEL', KEYS[5], ref)
+end
+if requeued > 0 then
+	redis.call('LPUSH', KEYS[6], 1)
+	redis.call('LTRIM', KEYS[6], 0, 99)
+end
+return requeued
+`)
+
+// deadLetterSortedEntryScript moves the entry from processing to the dead letters and removes
+// its payload. It returns zero if the entry isn't claimed with the token anymore.
+//
+// KEYS: processing references, processing priorities, processing leases, processing tokens, dead references, dead payloads, reaps, referenceUri
+// ARGV: dead letter, failed at in unix milliseconds, claim token
+var deadLetterSortedEntryScript = redis.NewScript(`
+if redis.call('HGET', KEYS[4], KEYS[8]) ~= ARGV[3] then
+	return 0
+end
+redis.call('SREM', KEYS[1], KEYS[8])
+redis.call('HDEL', KEYS[2], KEYS[8])
+redis.call('ZREM', KEYS[3], KEYS[8])
+redis.call('HDEL', KEYS[4], KEYS[8])
+redis.call('HSET', KEYS[6], KEYS[8], ARGV[1])
+redis.call('ZADD', KEYS[5], ARGV[2], KEYS[8])
+redis.call('HDEL', KEYS[7], KEYS[8])
+redis.call('DEL', KEYS[8])
+return 1
+`)
+
+// requeueDeadSortedEntryScript stores the payload of a dead letter, adds it back to the queue
+// and removes it from the dead letters. It returns zero if the dead letter doesn't exist.
+//
+// KEYS: queue, dead references, dead payloads, notifications, referenceUri
+// ARGV: payload, priority, expiration in milliseconds (zero never expires)
+var requeueDeadSortedEntryScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[3], KEYS[5]) == 0 then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[5], ARGV[1], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[5], ARGV[1])
+end
+redis.call('ZADD', KEYS[1], 'NX', ARGV[2], KEYS[5])
+redis.call('ZREM', KEYS[2], KEYS[5])
+redis.call('HDEL', KEYS[3], KEYS[5])
+redis.call('LPUSH', KEYS[4], 1)
+redis.call('LTRIM', KEYS[4], 0, 99)
+return 1
+`)
+
+// cleanSortedEntryDeadLettersScript removes the dead letters failed before the given time
+// and returns the amount of the removed dead letters
+//
+// KEYS: dead references, dead payloads
+// ARGV: failed before in unix milliseconds
+var cleanSortedEntryDeadLettersScript = redis.NewScript(`
+local refs = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1])
+for _, ref in ipairs(refs) do
+	redis.call('HDEL', KEYS[2], ref)
+	redis.call('ZREM', KEYS[1], ref)
+end
+return #refs
+`)
+
+// removeSortedEntryScript removes the entry from the queue, the scheduled and the processing
+// entries along with its payload, and returns zero if the entry doesn't exist
+//
+// KEYS: queue, scheduled references, scheduled priorities, processing references, processing priorities, processing leases, processing tokens, reaps, referenceUri
+var removeSortedEntryScript = redis.NewScript(`
+local removed = redis.call('ZREM', KEYS[1], KEYS[9])
+removed = removed + redis.call('ZREM', KEYS[2], KEYS[9])
+redis.call('HDEL', KEYS[3], KEYS[9])
+removed = removed + redis.call('SREM', KEYS[4], KEYS[9])
+redis.call('HDEL', KEYS[5], KEYS[9])
+redis.call('ZREM', KEYS[6], KEYS[9])
+redis.call('HDEL', KEYS[7], KEYS[9])
+redis.call('HDEL', KEYS[8], KEYS[9])
+removed = removed + redis.call('DEL', KEYS[9])
+return removed
+`)
+
+// setSortedEntryPriorityScript changes the priority of the entry wherever it is and replaces
+// its payload with the updated one. It returns -1 if the payload has changed since it was
+// read, otherwise zero if the entry doesn't exist.
+//
+// KEYS: queue, scheduled references, scheduled priorities, processing references, processing priorities, processing leases, processing tokens, reaps, referenceUri
+// ARGV: priority, payload as it was read, updated payload
+var setSortedEntryPriorityScript = redis.NewScript(`
+local payload = redis.call('GET', KEYS[9])
+if (payload or '') ~= ARGV[2] then
+	return -1
+end
+local found = 0
+if redis.call('ZSCORE', KEYS[1], KEYS[9]) then
+	redis.call('ZADD', KEYS[1], 'XX', ARGV[1], KEYS[9])
+	found = 1
+end
+if redis.call('ZSCORE', KEYS[2], KEYS[9]) then
+	redis.call('HSET', KEYS[3], KEYS[9], ARGV[1])
+	found = 1
+end
+if redis.call('SISMEMBER', KEYS[4], KEYS[9]) == 1 then
+	redis.call('HSET', KEYS[5], KEYS[9], ARGV[1])
+	found = 1
+end
+if payload then
+	local ttl = redis.call('PTTL', KEYS[9])
+	if ttl > 0 then
+		redis.call('SET', KEYS[9], ARGV[3], 'PX', ttl)
+	else
+		redis.call('SET', KEYS[9], ARGV[3])
+	end
+end
+return found
+`)
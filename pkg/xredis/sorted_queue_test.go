@@ -0,0 +1,1123 @@
+package xredis_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aminpaks/go-streams/pkg/testrun"
+	"github.com/aminpaks/go-streams/pkg/xredis"
+)
+
+func TestSortedQueueConsumer(t *testing.T) {
+	t.Parallel()
+
+	r := testrun.New(t)
+
+	r.Run(
+		r.It("Should remove processed entries from the queue and processing", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			processed := make(chan xredis.XSortedQueueEntry, 1)
+			xredis.NewSortedQueueConsumer(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for i := range entries {
+					processed <- entries[i]
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {})
+
+			select {
+			case e := <-processed:
+				assert.Equal("value", e.Value)
+				assert.Equal(entry.ReferenceUri, e.ReferenceUri)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+
+			assert.Eventually(func() bool {
+				exists, err := client.Exists(context.Background(), entry.ReferenceUri).Result()
+				return err == nil && exists == 0
+			}, time.Second*2, time.Millisecond*10)
+			assert.Equal(int64(0), client.ZCard(context.Background(), "queue").Val())
+			assert.Equal(int64(0), client.SCard(context.Background(), "sortedQueue::queue::processing::reference").Val())
+			assert.Equal(int64(0), client.HLen(context.Background(), "sortedQueue::queue::processing::priory").Val())
+		}),
+
+		r.It("Should retry failed entries with a lower priority", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 10, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			processed := make(chan xredis.XSortedQueueEntry, 2)
+			xredis.NewSortedQueueConsumer(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for i := range entries {
+					processed <- entries[i]
+					if entries[i].CurrentRetries == 0 {
+						entries[i].Retry(errors.New("failed"))
+					}
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {})
+
+			for retries := 0; retries < 2; retries++ {
+				select {
+				case e := <-processed:
+					assert.Equal(retries, e.CurrentRetries)
+					if retries == 1 {
+						assert.InDelta(11, e.Priority, 0.001)
+						assert.Equal([]string{"failed"}, e.Failures)
+					}
+				case <-time.After(time.Second * 5):
+					assert.FailNow("entry was not processed")
+				}
+			}
+		}),
+
+		r.It("Should delay the retries of failed entries by the retry policy", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 0, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			processed := make(chan xredis.XSortedQueueEntry, 2)
+			options := xredis.NewXSortedQueueOptions()
+			options.RetryPolicy = xredis.ConstantRetryPolicy(time.Millisecond * 200)
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for i := range entries {
+					processed <- entries[i]
+					if entries[i].CurrentRetries == 0 {
+						entries[i].Retry(errors.New("failed"))
+					}
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			var failedAt time.Time
+			select {
+			case <-processed:
+				failedAt = time.Now()
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+			select {
+			case e := <-processed:
+				assert.Equal(1, e.CurrentRetries)
+				assert.Equal(float64(0), e.Priority)
+				assert.GreaterOrEqual(int64(time.Since(failedAt)), int64(time.Millisecond*150))
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not retried")
+			}
+		}),
+
+		r.It("Should retry the entries of a batch that times out", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			processed := make(chan xredis.XSortedQueueEntry, 2)
+			options := xredis.NewXSortedQueueOptions()
+			options.BatchTimeout = time.Millisecond * 100
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for i := range entries {
+					processed <- entries[i]
+				}
+				if entries[0].CurrentRetries == 0 {
+					// Blocks the first attempt until the batch times out
+					<-ctx.Done()
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			<-processed
+			select {
+			case e := <-processed:
+				assert.Equal(1, e.CurrentRetries)
+				if assert.Len(e.Failures, 1) {
+					assert.True(strings.HasPrefix(e.Failures[0], xredis.ErrSortedQueueTimeout.Error()))
+				}
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not retried")
+			}
+		}),
+
+		r.It("Should not let a timed out batch ack the entries claimed again", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			reclaimed := make(chan struct{})
+			late := make(chan []error, 1)
+			options := xredis.NewXSortedQueueOptions()
+			options.Consumers = 2
+			options.BatchTimeout = time.Millisecond * 200
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				if entries[0].CurrentRetries == 0 {
+					// Keeps going after the batch has timed out and the entry is claimed again
+					<-reclaimed
+					late <- []error{entries[0].Ack(), entries[0].CleanUp()}
+					return entries
+				}
+				if entries[0].CurrentRetries == 1 {
+					close(reclaimed)
+					// Holds on to the entry until its own batch times out
+					<-ctx.Done()
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			select {
+			case errs := <-late:
+				for _, err := range errs {
+					assert.ErrorIs(err, xredis.ErrSortedQueueLeaseLost)
+				}
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not claimed again")
+			}
+			// The consumer that claimed the entry again still owns it
+			processing, err := xredis.NewSortedQueue(client, "queue").ListProcessing(depsCtx)
+			assert.Nil(err)
+			if assert.Len(processing, 1) {
+				assert.Equal(1, processing[0].Entry.CurrentRetries)
+			}
+		}),
+
+		r.It("Should retry the entries that exceed their timeout", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			fast := xredis.NewXSortedQueueEntry("fast", 1, xredis.NewUri("users", "1"), 0)
+			slow := xredis.NewXSortedQueueEntry("slow", 2, xredis.NewUri("users", "2"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", fast))
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", slow))
+
+			var fastCalls int32
+			retried := make(chan xredis.XSortedQueueEntry, 1)
+			options := xredis.NewXSortedQueueOptions()
+			options.EntryTimeout = time.Millisecond * 100
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", xredis.NewSortedQueueEntryHandler(func(ctx context.Context, entry xredis.XSortedQueueEntry, consumerId string) error {
+				if entry.Value == "fast" {
+					atomic.AddInt32(&fastCalls, 1)
+					return nil
+				}
+				if entry.CurrentRetries > 0 {
+					retried <- entry
+					return nil
+				}
+				<-ctx.Done()
+				return ctx.Err()
+			}), func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			select {
+			case e := <-retried:
+				assert.Equal(slow.ReferenceUri, e.ReferenceUri)
+				if assert.Len(e.Failures, 1) {
+					assert.True(strings.HasPrefix(e.Failures[0], xredis.ErrSortedQueueTimeout.Error()))
+				}
+			case <-time.After(time.Second * 5):
+				assert.FailNow("slow entry was not retried")
+			}
+			// Only the slow entry is retried
+			assert.Equal(int32(1), atomic.LoadInt32(&fastCalls))
+		}),
+
+		r.It("Should move exhausted entries to the dead letters and requeue them", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			processed := make(chan xredis.XSortedQueueEntry, 3)
+			failed := make(chan xredis.XFailure, 1)
+			options := xredis.NewXSortedQueueOptions()
+			options.MaxRetries = 1
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for i := range entries {
+					processed <- entries[i]
+					entries[i].Retry(fmt.Errorf("failed %d", entries[i].CurrentRetries))
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {
+				for _, f := range failures {
+					failed <- f
+				}
+			}, options)
+
+			select {
+			case f := <-failed:
+				assert.Equal("retries exhausted", f.Err.Error())
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not exhausted")
+			}
+			assert.Len(processed, 2)
+
+			deadLetters, err := xredis.ListSortedQueueDeadLetters(client, depsCtx, "queue", 10)
+			assert.Nil(err)
+			if assert.Len(deadLetters, 1) {
+				assert.Equal("queue", deadLetters[0].Queue)
+				assert.Equal(entry.ReferenceUri, deadLetters[0].Entry.ReferenceUri)
+				assert.Equal([]string{"failed 0", "failed 1"}, deadLetters[0].Entry.Failures)
+			}
+			// The payload doesn't leak
+			assert.Equal(int64(0), client.Exists(context.Background(), entry.ReferenceUri).Val())
+			assert.Equal(int64(0), client.SCard(context.Background(), "sortedQueue::queue::processing::reference").Val())
+
+			assert.Nil(xredis.RequeueSortedQueueDeadLetter(client, depsCtx, "queue", entry.ReferenceUri))
+			<-processed
+			<-processed
+			select {
+			case e := <-processed:
+				assert.Equal(0, e.CurrentRetries)
+				assert.Equal([]string{"failed 0", "failed 1"}, e.Failures)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not requeued")
+			}
+			<-failed
+
+			assert.Nil(xredis.PurgeSortedQueueDeadLetters(client, depsCtx, "queue", entry.ReferenceUri))
+			deadLetters, err = xredis.ListSortedQueueDeadLetters(client, depsCtx, "queue", 10)
+			assert.Nil(err)
+			assert.Len(deadLetters, 0)
+			assert.True(errors.Is(xredis.RequeueSortedQueueDeadLetter(client, depsCtx, "queue", entry.ReferenceUri), xredis.ErrSortedQueueDeadLetter))
+		}),
+
+		r.It("Should remove the dead letters after the retention", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			options := xredis.NewXSortedQueueOptions()
+			options.MaxRetries = 0
+			options.DeadLetterRetention = time.Millisecond * 200
+			options.CleanupInterval = time.Millisecond * 20
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for i := range entries {
+					entries[i].Retry(errors.New("failed"))
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			assert.Eventually(func() bool {
+				deadLetters, err := xredis.ListSortedQueueDeadLetters(client, depsCtx, "queue", 10)
+				return err == nil && len(deadLetters) == 1
+			}, time.Second*2, time.Millisecond*10)
+			assert.Eventually(func() bool {
+				deadLetters, err := xredis.ListSortedQueueDeadLetters(client, depsCtx, "queue", 10)
+				return err == nil && len(deadLetters) == 0
+			}, time.Second*2, time.Millisecond*10)
+		}),
+
+		r.It("Should revive the entries left in processing", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Simulates a consumer that crashed after claiming the entry
+			entry := xredis.NewXSortedQueueEntry("value", 5, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+			assert.Nil(client.ZRem(context.Background(), "queue", entry.ReferenceUri).Err())
+			assert.Nil(client.SAdd(context.Background(), "sortedQueue::queue::processing::reference", entry.ReferenceUri).Err())
+			assert.Nil(client.HSet(context.Background(), "sortedQueue::queue::processing::priory", entry.ReferenceUri, 5).Err())
+
+			processed := make(chan xredis.XSortedQueueEntry, 1)
+			xredis.NewSortedQueueConsumer(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for i := range entries {
+					processed <- entries[i]
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {})
+
+			select {
+			case e := <-processed:
+				assert.Equal(entry.ReferenceUri, e.ReferenceUri)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not revived")
+			}
+		}),
+
+		r.It("Should requeue the entries with an expired lease", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			processed := make(chan string, 2)
+			release := make(chan struct{})
+			defer close(release)
+			var calls int32
+			options := xredis.NewXSortedQueueOptions()
+			options.Consumers = 2
+			options.VisibilityTimeout = time.Millisecond * 200
+			options.ReapInterval = time.Millisecond * 50
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				processed <- consumerId
+				// The first consumer hangs until the end of the test
+				if atomic.AddInt32(&calls, 1) == 1 {
+					<-release
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			consumers := []string{}
+			for len(consumers) < 2 {
+				select {
+				case consumerId := <-processed:
+					consumers = append(consumers, consumerId)
+				case <-time.After(time.Second * 5):
+					assert.FailNow("entry was not requeued")
+				}
+			}
+			assert.NotEqual(consumers[0], consumers[1])
+		}),
+
+		r.It("Should move the entries that keep hanging their consumers to the dead letters", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			release := make(chan struct{})
+			defer close(release)
+			var calls int32
+			options := xredis.NewXSortedQueueOptions()
+			options.MaxRetries = 1
+			options.Consumers = 3
+			options.VisibilityTimeout = time.Millisecond * 100
+			options.ReapInterval = time.Millisecond * 20
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				// Every consumer hangs until the end of the test
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			var deadLetters []xredis.XSortedQueueDeadLetter
+			assert.Eventually(func() bool {
+				deadLetters, _ = xredis.ListSortedQueueDeadLetters(client, depsCtx, "queue", 10)
+				return len(deadLetters) == 1
+			}, time.Second*5, time.Millisecond*20)
+			// The entry is processed once and retried once before the second expired lease exhausts its retries
+			assert.Equal(int32(2), atomic.LoadInt32(&calls))
+			assert.Equal(2, deadLetters[0].Entry.CurrentRetries)
+			assert.Contains(deadLetters[0].Entry.Failures, xredis.ErrSortedQueueTimeout.Error()+": expired leases: 2")
+			assert.Equal(int64(0), client.Exists(depsCtx, "sortedQueue::queue::reaps").Val())
+		}),
+
+		r.It("Should not let the consumer of an expired lease ack or retry the entry", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			reclaimed := make(chan struct{})
+			release := make(chan struct{})
+			defer close(release)
+			acks := make(chan error, 1)
+			failures := make(chan error, 1)
+			var calls int32
+			options := xredis.NewXSortedQueueOptions()
+			options.Consumers = 2
+			options.VisibilityTimeout = time.Millisecond * 200
+			options.ReapInterval = time.Millisecond * 50
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					// The first consumer outlives its lease and finishes after the entry is claimed again
+					<-reclaimed
+					acks <- entries[0].Ack()
+					return entries
+				}
+				close(reclaimed)
+				<-release
+				return entries
+			}, func(f []xredis.XFailure, consumerId string) {
+				for _, failure := range f {
+					failures <- failure.Err
+				}
+			}, options)
+
+			select {
+			case err := <-acks:
+				assert.ErrorIs(err, xredis.ErrSortedQueueLeaseLost)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not claimed again")
+			}
+			select {
+			case err := <-failures:
+				assert.ErrorIs(err, xredis.ErrSortedQueueLeaseLost)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("retry was not reported")
+			}
+
+			// The entry stays with the consumer that claimed it again
+			processing, err := xredis.NewSortedQueue(client, "queue").ListProcessing(depsCtx)
+			assert.Nil(err)
+			assert.Len(processing, 1)
+			assert.Equal(int64(0), client.ZCard(depsCtx, "queue").Val())
+			assert.Equal(int64(1), client.Exists(depsCtx, entry.ReferenceUri).Val())
+		}),
+
+		r.It("Should keep the extended entries leased", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			processed := make(chan error, 2)
+			options := xredis.NewXSortedQueueOptions()
+			options.VisibilityTimeout = time.Millisecond * 100
+			options.ReapInterval = time.Millisecond * 20
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for i := range entries {
+					err := entries[i].Extend(time.Hour)
+					// Outlives the visibility timeout
+					time.Sleep(time.Millisecond * 300)
+					processed <- err
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			select {
+			case err := <-processed:
+				assert.Nil(err)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+			assert.Never(func() bool {
+				return len(processed) > 0
+			}, time.Millisecond*300, time.Millisecond*20)
+		}),
+
+		r.It("Should hide the scheduled entries until they're due", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			runAt := time.Now().Add(time.Millisecond * 300)
+			low := xredis.NewXSortedQueueEntry("low", 2, xredis.NewUri("users", "1"), 0)
+			low.RunAt = runAt
+			high := xredis.NewXSortedQueueEntry("high", 1, xredis.NewUri("users", "2"), 0)
+			high.RunAt = runAt
+			delayed := xredis.NewXSortedQueueEntry("delayed", 1, xredis.NewUri("users", "3"), 0)
+			delayed.Delay = time.Hour
+			now := xredis.NewXSortedQueueEntry("now", 3, xredis.NewUri("users", "4"), 0)
+			for _, e := range []xredis.XSortedQueueEntry{low, high, delayed, now} {
+				assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", e))
+			}
+			// Only the scheduled entries are stored with their due time
+			assert.NotContains(client.Get(depsCtx, now.ReferenceUri).Val(), "runAt")
+			scheduled, err := xredis.NewSortedQueue(client, "queue").Get(depsCtx, high.ReferenceUri)
+			assert.Nil(err)
+			assert.True(runAt.Equal(scheduled.RunAt))
+
+			processed := make(chan []string, 3)
+			xredis.NewSortedQueueConsumer(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				values := []string{}
+				for _, e := range entries {
+					values = append(values, e.Value)
+				}
+				processed <- values
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {})
+
+			for _, expected := range [][]string{{"now"}, {"high", "low"}} {
+				select {
+				case values := <-processed:
+					assert.Equal(expected, values)
+				case <-time.After(time.Second * 5):
+					assert.FailNow("entries were not processed")
+				}
+			}
+			assert.False(time.Now().Before(runAt))
+			assert.Never(func() bool {
+				return len(processed) > 0
+			}, time.Millisecond*300, time.Millisecond*20)
+		}),
+
+		r.It("Should pause and resume the consumers", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			controller := xredis.NewSortedQueueController(client, "queue")
+			assert.Nil(controller.Pause(depsCtx))
+			paused, err := controller.IsPaused(depsCtx)
+			assert.Nil(err)
+			assert.True(paused)
+
+			processed := make(chan xredis.XSortedQueueEntry, 1)
+			options := xredis.NewXSortedQueueOptions()
+			// A separate controller shares the pause through Redis
+			options.Controller = xredis.NewSortedQueueController(client, "queue")
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for i := range entries {
+					processed <- entries[i]
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+			assert.Never(func() bool {
+				return len(processed) > 0
+			}, time.Millisecond*300, time.Millisecond*20)
+
+			assert.Nil(controller.Resume(depsCtx))
+			select {
+			case e := <-processed:
+				assert.Equal(entry.ReferenceUri, e.ReferenceUri)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+		}),
+
+		r.It("Should drain the consumers after their in-flight batches", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			processed := make(chan xredis.XSortedQueueEntry, 2)
+			release := make(chan struct{})
+			options := xredis.NewXSortedQueueOptions()
+			options.Controller = xredis.NewSortedQueueController(client, "queue")
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for i := range entries {
+					processed <- entries[i]
+				}
+				<-release
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			first := xredis.NewXSortedQueueEntry("first", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", first))
+			select {
+			case <-processed:
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+
+			// The in-flight batch keeps the drain waiting
+			ctx, cancelDrain := context.WithTimeout(context.Background(), time.Millisecond*100)
+			defer cancelDrain()
+			assert.Equal(context.DeadlineExceeded, options.Controller.Drain(ctx))
+			assert.True(options.Controller.IsDraining())
+
+			close(release)
+			assert.Nil(options.Controller.Drain(context.Background()))
+
+			second := xredis.NewXSortedQueueEntry("second", 1, xredis.NewUri("users", "2"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", second))
+			assert.Never(func() bool {
+				return len(processed) > 0
+			}, time.Millisecond*300, time.Millisecond*20)
+
+			assert.Nil(options.Controller.Resume(depsCtx))
+			select {
+			case e := <-processed:
+				assert.Equal("second", e.Value)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+		}),
+
+		r.It("Should drain the blocking consumers without waiting for their block timeout", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			processed := make(chan xredis.XSortedQueueEntry, 1)
+			options := xredis.NewXSortedQueueOptions()
+			options.Blocking = true
+			options.BlockTimeout = time.Second * 10
+			options.Controller = xredis.NewSortedQueueController(client, "queue")
+			xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for i := range entries {
+					processed <- entries[i]
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			// Lets the consumer find the queue empty and block
+			time.Sleep(time.Millisecond * 100)
+			ctx, cancelDrain := context.WithTimeout(context.Background(), time.Second)
+			defer cancelDrain()
+			assert.Nil(options.Controller.Drain(ctx))
+
+			// The notified consumer doesn't claim the entry once it's drained
+			entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+			assert.Never(func() bool {
+				return len(processed) > 0
+			}, time.Millisecond*300, time.Millisecond*20)
+			assert.Equal(int64(1), client.ZCard(depsCtx, "queue").Val())
+
+			assert.Nil(options.Controller.Resume(depsCtx))
+			select {
+			case e := <-processed:
+				assert.Equal(entry.ReferenceUri, e.ReferenceUri)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+		}),
+
+		r.It("Should scale the consumers with the queue depth and idle ratio", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			for i := 0; i < 60; i++ {
+				entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+				assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+			}
+
+			options := xredis.NewXSortedQueueOptions()
+			options.Consuming = 1
+			options.MinConsumers = 1
+			options.MaxConsumers = 3
+			options.ScaleInterval = time.Millisecond * 50
+			options.TargetLatency = time.Millisecond * 10
+			options.Controller = xredis.NewSortedQueueController(client, "queue")
+			done := xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				time.Sleep(time.Millisecond * 20)
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+			assert.Equal(1, options.Controller.Consumers())
+
+			assert.Eventually(func() bool {
+				return options.Controller.Consumers() == 3
+			}, time.Second*5, time.Millisecond*10)
+			// Scales down once the queue is empty and the consumers are idle
+			assert.Eventually(func() bool {
+				return options.Controller.Consumers() == 1
+			}, time.Second*5, time.Millisecond*10)
+			assert.Equal(int64(0), client.ZCard(depsCtx, "queue").Val())
+
+			cancel()
+			<-done
+			assert.Equal(0, options.Controller.Consumers())
+		}),
+
+		r.It("Should report the running consumers without a controller", func(t *testing.T) {
+			assert := assert.New(t)
+
+			_, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+
+			changes := make(chan int, 4)
+			options := xredis.NewXSortedQueueOptions()
+			options.Consumers = 2
+			options.OnConsumersChange = func(consumers int) {
+				changes <- consumers
+			}
+			done := xredis.NewSortedQueueConsumerWithOptions(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+
+			cancel()
+			<-done
+			close(changes)
+			reported := []int{}
+			for consumers := range changes {
+				reported = append(reported, consumers)
+			}
+			assert.Equal([]int{1, 2, 1, 0}, reported)
+		}),
+
+		r.It("Should wake the blocking consumers once an entry is enqueued", func(t *testing.T) {
+			_, client := buildStreamTestMocks(t)
+			testBlockingSortedQueueConsumer(t, client, "queue")
+		}),
+
+		r.It("Should wake the blocking consumers of a Redis server once an entry is enqueued", func(t *testing.T) {
+			url := os.Getenv("REDIS_URL")
+			if url == "" {
+				t.Skip("REDIS_URL is required to test the blocking consumer against Redis")
+			}
+			options, err := redis.ParseURL(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := redis.NewClient(options)
+			t.Cleanup(func() {
+				client.Close()
+			})
+			testBlockingSortedQueueConsumer(t, client, fmt.Sprintf("test-blocking-%d", time.Now().UnixNano()))
+		}),
+	)
+}
+
+// testBlockingSortedQueueConsumer checks that a blocking consumer is woken up by the enqueued
+// entries long before its block timeout, and that the notifications don't pile up
+func testBlockingSortedQueueConsumer(t *testing.T, client *redis.Client, queue string) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	notifyKey := fmt.Sprintf("sortedQueue::%s::notify", queue)
+	t.Cleanup(func() {
+		client.Del(ctx, queue, notifyKey)
+	})
+
+	shutdown, cancel := context.WithCancel(ctx)
+	processed := make(chan xredis.XSortedQueueEntry, 1)
+	options := xredis.NewXSortedQueueOptions()
+	options.Blocking = true
+	options.BlockTimeout = time.Second * 10
+	done := xredis.NewSortedQueueConsumerWithOptions(client, shutdown, queue, func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+		for i := range entries {
+			processed <- entries[i]
+		}
+		return entries
+	}, func(failures []xredis.XFailure, consumerId string) {
+		assert.Fail("unexpected failures", failures)
+	}, options)
+
+	// Lets the consumer find the queue empty and block
+	time.Sleep(time.Millisecond * 100)
+	entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", "1"), 0)
+	enqueuedAt := time.Now()
+	assert.Nil(xredis.EnqueueSortedEntry(client, ctx, queue, entry))
+
+	select {
+	case e := <-processed:
+		assert.Equal(entry.ReferenceUri, e.ReferenceUri)
+		assert.Less(int64(time.Since(enqueuedAt)), int64(time.Second))
+	case <-time.After(time.Second * 5):
+		assert.FailNow("entry was not processed")
+	}
+	// The entry is cleaned up once the batch is done
+	cancel()
+	<-done
+
+	for i := 0; i < 150; i++ {
+		entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("users", fmt.Sprint(i)), time.Minute)
+		assert.Nil(xredis.EnqueueSortedEntry(client, ctx, queue, entry))
+	}
+	assert.Equal(int64(100), client.LLen(ctx, notifyKey).Val())
+}
+
+// BenchmarkSortedQueueConsumer measures the latency of an entry from being enqueued until
+// it's processed, along with the commands sent to Redis per entry and per idle second.
+// It runs against miniredis unless REDIS_URL is set.
+func BenchmarkSortedQueueConsumer(b *testing.B) {
+	for _, blocking := range []bool{false, true} {
+		name := "polling"
+		if blocking {
+			name = "blocking"
+		}
+		b.Run(name, func(b *testing.B) {
+			client := buildSortedQueueBenchmarkClient(b)
+			counter := &commandCounter{}
+			client.AddHook(counter)
+
+			queue := xredis.NewUri("benchmark", "sortedQueue")
+			shutdown, cancel := context.WithCancel(context.Background())
+			processed := make(chan struct{}, 1)
+			options := xredis.NewXSortedQueueOptions()
+			options.Blocking = blocking
+			done := xredis.NewSortedQueueConsumerWithOptions(client, shutdown, queue, func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				for range entries {
+					processed <- struct{}{}
+				}
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {}, options)
+			defer func() {
+				cancel()
+				<-done
+				client.Del(context.Background(), queue)
+			}()
+
+			atomic.StoreInt64(&counter.count, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				entry := xredis.NewXSortedQueueEntry("value", 1, xredis.NewUri("benchmark", "entry"), 0)
+				if err := xredis.EnqueueSortedEntry(client, context.Background(), queue, entry); err != nil {
+					b.Fatal(err)
+				}
+				<-processed
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&counter.count))/float64(b.N), "cmds/op")
+
+			// Commands sent while there's nothing to consume are what the consumers cost when idle
+			atomic.StoreInt64(&counter.count, 0)
+			time.Sleep(time.Second)
+			b.ReportMetric(float64(atomic.LoadInt64(&counter.count)), "idle-cmds/s")
+		})
+	}
+}
+
+func buildSortedQueueBenchmarkClient(b *testing.B) *redis.Client {
+	if url := os.Getenv("REDIS_URL"); url != "" {
+		options, err := redis.ParseURL(url)
+		if err != nil {
+			b.Fatal(err)
+		}
+		client := redis.NewClient(options)
+		b.Cleanup(func() {
+			client.Close()
+		})
+		return client
+	}
+	mr, err := miniredis.Run()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(mr.Close)
+	return redis.NewClient(&redis.Options{Addr: mr.Addr()})
+}
+
+// commandCounter counts the commands sent to Redis
+type commandCounter struct {
+	count int64
+}
+
+func (c *commandCounter) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	atomic.AddInt64(&c.count, 1)
+	return ctx, nil
+}
+func (c *commandCounter) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+func (c *commandCounter) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	atomic.AddInt64(&c.count, int64(len(cmds)))
+	return ctx, nil
+}
+func (c *commandCounter) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestXSortedQueueOptions(t *testing.T) {
+	t.Parallel()
+
+	r := testrun.New(t)
+
+	r.Run(
+		r.It("Should lease the entries and expire the dead letters of custom options by default", func(t *testing.T) {
+			assert := assert.New(t)
+
+			options := &xredis.XSortedQueueOptions{MaxRetries: 3}
+			options.Initialize()
+			assert.Equal(time.Minute*5, options.VisibilityTimeout)
+			assert.Equal(time.Minute*5/2, options.ReapInterval)
+			assert.Equal(time.Hour*24*7, options.DeadLetterRetention)
+			assert.Equal(time.Minute, options.CleanupInterval)
+		}),
+
+		r.It("Should keep the leases and the dead letter retention disabled", func(t *testing.T) {
+			assert := assert.New(t)
+
+			options := &xredis.XSortedQueueOptions{VisibilityTimeout: -1, DeadLetterRetention: -1}
+			options.Initialize()
+			assert.Equal(time.Duration(-1), options.VisibilityTimeout)
+			assert.Equal(time.Duration(0), options.ReapInterval)
+			assert.Equal(time.Duration(-1), options.DeadLetterRetention)
+			assert.Equal(time.Duration(0), options.CleanupInterval)
+		}),
+	)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	r := testrun.New(t)
+
+	r.Run(
+		r.It("Should lower the priority by default", func(t *testing.T) {
+			assert := assert.New(t)
+
+			priority, delay := xredis.DefaultRetryPolicy.Next(xredis.NewXSortedQueueEntry("value", 10, "", 0))
+			assert.InDelta(11, priority, 0.001)
+			assert.Equal(time.Duration(0), delay)
+		}),
+
+		r.It("Should keep the priority and grow the delays", func(t *testing.T) {
+			assert := assert.New(t)
+
+			entry := xredis.NewXSortedQueueEntry("value", 10, "", 0)
+			linear := []time.Duration{}
+			exponential := []time.Duration{}
+			for entry.CurrentRetries = 0; entry.CurrentRetries < 4; entry.CurrentRetries++ {
+				priority, delay := xredis.LinearRetryPolicy(time.Second, time.Second*3).Next(entry)
+				assert.Equal(float64(10), priority)
+				linear = append(linear, delay)
+				_, delay = xredis.ExponentialRetryPolicy(time.Second, time.Second*5).Next(entry)
+				exponential = append(exponential, delay)
+			}
+			assert.Equal([]time.Duration{time.Second, time.Second * 2, time.Second * 3, time.Second * 3}, linear)
+			assert.Equal([]time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5}, exponential)
+		}),
+
+		r.It("Should use the custom policy", func(t *testing.T) {
+			assert := assert.New(t)
+
+			policy := xredis.RetryPolicyFunc(func(entry xredis.XSortedQueueEntry) (float64, time.Duration) {
+				return entry.Priority + 1, time.Minute
+			})
+			priority, delay := policy.Next(xredis.NewXSortedQueueEntry("value", 0, "", 0))
+			assert.Equal(float64(1), priority)
+			assert.Equal(time.Minute, delay)
+		}),
+	)
+}
+
+func TestSortedQueue(t *testing.T) {
+	t.Parallel()
+
+	r := testrun.New(t)
+
+	r.Run(
+		r.It("Should inspect, reprioritize and remove the entries", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			refs := []string{}
+			for i := 1; i <= 3; i++ {
+				entry := xredis.NewXSortedQueueEntry(fmt.Sprintf("value %d", i), float64(i), xredis.NewUri("users", "1"), time.Hour)
+				assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+				refs = append(refs, entry.ReferenceUri)
+			}
+
+			q := xredis.NewSortedQueue(client, "queue")
+			n, err := q.Len(depsCtx)
+			assert.Nil(err)
+			assert.Equal(int64(3), n)
+
+			assert.Nil(q.SetPriority(depsCtx, refs[2], 0))
+			entries, err := q.Peek(depsCtx, 2)
+			assert.Nil(err)
+			if assert.Len(entries, 2) {
+				assert.Equal(refs[2], entries[0].ReferenceUri)
+				assert.Equal(float64(0), entries[0].Priority)
+				assert.Equal(refs[0], entries[1].ReferenceUri)
+			}
+			entry, err := q.Get(depsCtx, refs[2])
+			assert.Nil(err)
+			assert.Equal("value 3", entry.Value)
+			assert.Equal(float64(0), entry.Priority)
+			assert.Equal(time.Hour, entry.Expiration)
+			assert.Greater(int64(client.PTTL(depsCtx, refs[2]).Val()), int64(0))
+
+			assert.Nil(q.Remove(depsCtx, refs[0]))
+			n, err = q.Len(depsCtx)
+			assert.Nil(err)
+			assert.Equal(int64(2), n)
+			assert.Equal(int64(0), client.Exists(depsCtx, refs[0]).Val())
+
+			assert.True(errors.Is(q.Remove(depsCtx, refs[0]), xredis.ErrSortedQueueEntryNotFound))
+			assert.True(errors.Is(q.SetPriority(depsCtx, refs[0], 1), xredis.ErrSortedQueueEntryNotFound))
+			_, err = q.Get(depsCtx, refs[0])
+			assert.True(errors.Is(err, xredis.ErrSortedQueueEntryNotFound))
+		}),
+
+		r.It("Should list the processing entries with their leases", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			entry := xredis.NewXSortedQueueEntry("value", 3, xredis.NewUri("users", "1"), 0)
+			assert.Nil(xredis.EnqueueSortedEntry(client, depsCtx, "queue", entry))
+
+			claimed := make(chan struct{})
+			release := make(chan struct{})
+			defer close(release)
+			xredis.NewSortedQueueConsumer(client, shutdown, "queue", func(ctx context.Context, entries []xredis.XSortedQueueEntry, consumerId string) []xredis.XSortedQueueEntry {
+				close(claimed)
+				<-release
+				return entries
+			}, func(failures []xredis.XFailure, consumerId string) {})
+
+			select {
+			case <-claimed:
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not claimed")
+			}
+
+			q := xredis.NewSortedQueue(client, "queue")
+			processing, err := q.ListProcessing(depsCtx)
+			assert.Nil(err)
+			if assert.Len(processing, 1) {
+				assert.Equal(entry.ReferenceUri, processing[0].Entry.ReferenceUri)
+				assert.Equal("value", processing[0].Entry.Value)
+				assert.Equal(float64(3), processing[0].Entry.Priority)
+				assert.True(processing[0].LeaseDeadline.After(time.Now()))
+			}
+			n, err := q.Len(depsCtx)
+			assert.Nil(err)
+			assert.Equal(int64(0), n)
+		}),
+	)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -16,116 +17,447 @@ import (
 type RedisClient = redis.Client
 type StreamConsumerFunc func(entry XStreamEntry, consumerId string) error
 
+// StreamBatchConsumerFunc processes a batch of entries at once, the returned errors
+// correspond to the entries by their index and nil or missing errors mean success
+type StreamBatchConsumerFunc func(entries []XStreamEntry, consumerId string) []error
+
 var ErrStreamConsumer = errors.New("stream consumer")
 var ErrStreamAppend = errors.New("failed to append")
 
-func RegisterStreamConsumer(ctx context.Context, streamName string, groupName string, consumerFn StreamConsumerFunc, options *StreamConsumerOptions) error {
+// RegisterStreamConsumer starts the consumers of the stream group. Consumers keep reading
+// the stream until shutdown is cancelled, and the returned channel is closed once all of
+// them have finished processing their in-flight entries.
+func RegisterStreamConsumer(
+	depsCtx context.Context,
+	shutdown context.Context,
+	streamName string,
+	groupName string,
+	consumerFn StreamConsumerFunc,
+	options *StreamConsumerOptions,
+) (chan struct{}, error) {
+	return RegisterStreamBatchConsumer(depsCtx, shutdown, streamName, groupName, batchStreamConsumer(consumerFn), options)
+}
+
+// RegisterStreamBatchConsumer works like RegisterStreamConsumer but hands
+// the entries read at once to the consumer as a batch
+func RegisterStreamBatchConsumer(
+	depsCtx context.Context,
+	shutdown context.Context,
+	streamName string,
+	groupName string,
+	consumerFn StreamBatchConsumerFunc,
+	options *StreamConsumerOptions,
+) (chan struct{}, error) {
 	// Get the Redis client from dependency context
-	client, err := GetClient(ctx)
+	client, err := GetClient(depsCtx)
 	if err != nil {
-		return fmt.Errorf("%w: %v", ErrStreamConsumer, err)
+		return nil, fmt.Errorf("%w: %v", ErrStreamConsumer, err)
 	}
 	if options == nil {
 		options = NewStreamConsumerOptions(1, 5)
 	}
 	options.Normalize() // Removes invalid options
+	if options.DeadLetterStream == "" {
+		options.DeadLetterStream = DeadLetterStreamName(streamName)
+	}
 
-	consumerCounter := uint(1)
-	for {
-		if consumerCounter > options.Counts {
-			break
-		}
+	if options.ConsumerPrefix == "" {
+		options.ConsumerPrefix = groupName
+	}
+
+	consumerIds := []string{}
+	for i := 1; i <= int(options.Counts); i++ {
+		consumerIds = append(consumerIds, ConsumerId(options.ConsumerPrefix, i))
+	}
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(len(consumerIds))
+	for _, consumerId := range consumerIds {
+		consumerId := consumerId
 		go func() {
-			consumerId := uuid.New().String()
+			defer wg.Done()
+			log.Printf("running stream consumer %s", consumerId)
 			for {
-				ctx := context.Background()
-				entries, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
-					Group:    groupName,
-					Consumer: consumerId,
-					Streams:  []string{streamName, ">"},
-					Count:    2,
-					Block:    0,
-					NoAck:    false,
-				}).Result()
-				if err != nil {
-					// NOGROUP is returned when the group doesn't exists
-					if strings.Contains(err.Error(), "NOGROUP") {
-						if b, err := client.SetNX(ctx, fmt.Sprintf("stream-[%s]-creation-lock", streamName), consumerId, time.Second*1).Result(); err != nil {
-							log.Printf("consumer %s waiting for lock", consumerId)
-							continue
-						} else if !b {
-							time.Sleep(time.Second * 1)
-							continue
-						}
-						err = client.XGroupCreateMkStream(ctx, streamName, groupName, "0").Err()
-						// BUSYGROUP is returned when the group already exists
-						// this error can happend if there are multiple consumers
-						if err != nil {
-							if strings.Contains(err.Error(), "BUSYGROUP") {
-								continue
-							}
-							log.Printf("ERROR: consumer '%s' failed to create stream '%s': %v", consumerId, streamName, err)
-						}
-					} else {
-						log.Printf("ERROR: consumer '%s' failed to read stream '%s': %v", consumerId, streamName, err)
-					}
-					time.Sleep(time.Second * 5)
-					continue
-				}
-				if len(entries) > 0 {
-					for i := range entries[0].Messages {
-						message := &entries[0].Messages[i]
-						messageID := message.ID
-						err = client.XAck(ctx, streamName, groupName, messageID).Err()
-						if err != nil {
-							log.Printf("failed to ack stream entry %s: %v", messageID, err)
-						}
-
-						entryData, err := parseStreamEntry(message.Values)
-						if err != nil {
-							log.Printf("failed to decode entry element: %v -> %s", err, message.Values)
-						}
-						entryErr := consumerFn(
-							*entryData.
-								WithIncreaseTries().
-								withMaxRetries(options.Retries),
-							consumerId,
-						)
-
-						if entryErr != nil {
-							if entryData.Retries < options.Retries {
-								// log.Printf("retrying %d stream entry -> %s", entryData.Retries, entryData.Value)
-								internalStreamAppend(ctx, streamName, entryData.
-									WithError(entryErr.Error()).
-									Build(),
-								)
-							} else {
-								log.Printf("consumer '%s' failed to process stream '%s' entry -> %s", consumerId, streamName, message.Values)
-							}
-						}
-					}
+				select {
+				case <-shutdown.Done():
+					log.Printf("stream consumer %s is done", consumerId)
+					return
+				default:
+					internalConsumeStream(client, shutdown, consumerId, streamName, groupName, consumerFn, *options)
 				}
 			}
 		}()
-		consumerCounter += 1
 	}
+	if options.RetryBackoff != nil && !options.AtLeastOnce {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runStreamScheduler(client, shutdown, streamName, *options)
+		}()
+	}
+	if options.Retention.isEnabled() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runStreamTrimmer(client, shutdown, streamName, *options)
+		}()
+	}
+	if options.ReclaimMinIdle > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runStreamReclaimer(client, shutdown, streamName, groupName, consumerIds, *options)
+		}()
+	}
+	// This go routine will make sure we close the channel once all the consumers
+	// safely completed their work on shuting down
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
 
-	return nil
+	return done, nil
 }
 
-func internalStreamAppend(depsCtx context.Context, streamName string, values map[string]interface{}) error {
-	client, err := GetClient(depsCtx)
+func internalConsumeStream(
+	client *RedisClient,
+	shutdown context.Context,
+	consumerId string,
+	streamName string,
+	groupName string,
+	consumerFn StreamBatchConsumerFunc,
+	options StreamConsumerOptions,
+) {
+	// In-flight entries must be processed even if we're shutting down,
+	// therefore we don't use the shutdown context for any of the calls
+	ctx := context.Background()
+	// Reclaimed entries are handed over as pending entries of the consumer
+	if options.AtLeastOnce || options.ReclaimMinIdle > 0 {
+		internalRetryPendingStreamEntries(client, consumerId, streamName, groupName, consumerFn, options)
+	}
+	entries, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    groupName,
+		Consumer: consumerId,
+		Streams:  []string{streamName, ">"},
+		Count:    options.ReadCount,
+		// Blocking for a limited time lets the consumer notice the shutdown
+		Block: options.ReadBlock,
+		NoAck: false,
+	}).Result()
 	if err != nil {
-		return fmt.Errorf("%w: %v", ErrStreamAppend, err)
+		// Nil is returned when the block timed out without any new entries
+		if err == redis.Nil {
+			sleepUntilShutdown(shutdown, options.IdleBackoff)
+			return
+		}
+		// NOGROUP is returned when the group doesn't exists
+		if strings.Contains(err.Error(), "NOGROUP") {
+			if b, err := client.SetNX(ctx, fmt.Sprintf("stream-[%s]-creation-lock", streamName), consumerId, time.Second*1).Result(); err != nil {
+				log.Printf("consumer %s waiting for lock", consumerId)
+				return
+			} else if !b {
+				sleepUntilShutdown(shutdown, time.Second*1)
+				return
+			}
+			err = client.XGroupCreateMkStream(ctx, streamName, groupName, "0").Err()
+			// BUSYGROUP is returned when the group already exists
+			// this error can happend if there are multiple consumers
+			if err == nil || strings.Contains(err.Error(), "BUSYGROUP") {
+				return
+			}
+			log.Printf("ERROR: consumer '%s' failed to create stream '%s': %v", consumerId, streamName, err)
+		} else {
+			log.Printf("ERROR: consumer '%s' failed to read stream '%s': %v", consumerId, streamName, err)
+		}
+		sleepUntilShutdown(shutdown, time.Second*5)
+		return
+	}
+	if len(entries) == 0 || len(entries[0].Messages) == 0 {
+		sleepUntilShutdown(shutdown, options.IdleBackoff)
+		return
+	}
+
+	messages := entries[0].Messages
+	if options.AtLeastOnce {
+		// New entries are delivered for the first time
+		deliveries := map[string]int64{}
+		for _, m := range messages {
+			deliveries[m.ID] = 1
+		}
+		processPendingStreamMessages(client, consumerId, streamName, groupName, consumerFn, options, messages, deliveries)
+		return
+	}
+
+	ids := []string{}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	if err := client.XAck(ctx, streamName, groupName, ids...).Err(); err != nil {
+		log.Printf("failed to ack stream entries %v: %v", ids, err)
+	}
+
+	batch := []XStreamEntry{}
+	batchIds := []string{}
+	for _, message := range messages {
+		entryData, err := parseStreamEntry(message.Values)
+		if err != nil {
+			log.Printf("failed to decode entry element: %v -> %s", err, message.Values)
+			continue
+		}
+		batch = append(batch, *entryData.
+			WithIncreaseTries().
+			withMaxRetries(options.Retries),
+		)
+		batchIds = append(batchIds, message.ID)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	entryErrs := consumerFn(batch, consumerId)
+	for i := range batch {
+		entryErr := streamEntryError(entryErrs, i)
+		if entryErr == nil {
+			continue
+		}
+		entryData := &batch[i]
+		if entryData.Retries < options.Retries && !errors.Is(entryErr, ErrDecode) {
+			entryData.WithError(entryErr.Error())
+			if delay := options.retryDelay(entryData.Retries); delay > 0 {
+				if err := scheduleStreamEntry(client, streamName, entryData, time.Now().Add(delay)); err != nil {
+					log.Printf("consumer '%s' failed to schedule the retry of stream '%s' entry %s: %v", consumerId, streamName, entryData.Id, err)
+				}
+				continue
+			}
+			if err := internalStreamAppend(client, streamName, entryData.Build()); err != nil {
+				log.Printf("consumer '%s' failed to retry stream '%s' entry %s: %v", consumerId, streamName, entryData.Id, err)
+			}
+		} else {
+			entryData.WithError(entryErr.Error())
+			if err := deadLetterStreamEntry(client, consumerId, streamName, groupName, options, batchIds[i], *entryData); err != nil {
+				log.Printf("consumer '%s' failed to process stream '%s' entry -> %s: %v", consumerId, streamName, entryData.Value, err)
+			}
+		}
+	}
+}
+
+// internalRetryPendingStreamEntries claims back the entries of the consumer's pending entries
+// list that have been idle long enough and processes them again. Claiming increases the
+// delivery count of the entries which is used as their retries count.
+func internalRetryPendingStreamEntries(
+	client *RedisClient,
+	consumerId string,
+	streamName string,
+	groupName string,
+	consumerFn StreamBatchConsumerFunc,
+	options StreamConsumerOptions,
+) {
+	ctx := context.Background()
+	deliveries := map[string]int64{}
+	ids := []string{}
+	// Entries still waiting for their backoff stay at the head of the list, so the list is
+	// paged through until enough of the due entries are found
+	start := "-"
+	for int64(len(ids)) < options.ReadCount {
+		pending, err := client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   streamName,
+			Group:    groupName,
+			Start:    start,
+			End:      "+",
+			Count:    streamPendingBatch,
+			Consumer: consumerId,
+		}).Result()
+		if err != nil {
+			if err != redis.Nil && !strings.Contains(err.Error(), "NOGROUP") {
+				log.Printf("ERROR: consumer '%s' failed to read pending entries of stream '%s': %v", consumerId, streamName, err)
+			}
+			return
+		}
+
+		for _, p := range pending {
+			// The delivery count is the amount of the attempts so far
+			if p.Idle < options.RetryIdle || p.Idle < options.retryDelay(int(p.RetryCount)) {
+				continue
+			}
+			// Claiming increases the delivery count by one
+			deliveries[p.ID] = p.RetryCount + 1
+			ids = append(ids, p.ID)
+			if int64(len(ids)) == options.ReadCount {
+				break
+			}
+		}
+
+		if len(pending) < streamPendingBatch {
+			break
+		}
+		start = nextStreamId(pending[len(pending)-1].ID)
+	}
+	if len(ids) == 0 {
+		return
 	}
 
-	err = client.XAdd(context.Background(), &redis.XAddArgs{
-		Stream:       streamName,
-		MaxLen:       0,
-		MaxLenApprox: 0,
-		ID:           "",
-		Values:       values,
-	}).Err()
+	messages, err := client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   streamName,
+		Group:    groupName,
+		Consumer: consumerId,
+		MinIdle:  options.RetryIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		log.Printf("ERROR: consumer '%s' failed to claim pending entries of stream '%s': %v", consumerId, streamName, err)
+		return
+	}
+	processPendingStreamMessages(client, consumerId, streamName, groupName, consumerFn, options, messages, deliveries)
+}
+
+// processPendingStreamMessages processes entries that stay in the pending entries list
+// until the consumer succeeds, and only then acknowledges them
+func processPendingStreamMessages(
+	client *RedisClient,
+	consumerId string,
+	streamName string,
+	groupName string,
+	consumerFn StreamBatchConsumerFunc,
+	options StreamConsumerOptions,
+	messages []redis.XMessage,
+	deliveries map[string]int64,
+) {
+	ctx := context.Background()
+	errorsKey := streamErrorsKey(streamName, groupName)
+
+	batch := []XStreamEntry{}
+	batchIds := []string{}
+	exhausted := []XStreamEntry{}
+	exhaustedIds := []string{}
+	for _, message := range messages {
+		if _, ok := deliveries[message.ID]; !ok {
+			// The entry was claimed by someone else in the meantime
+			continue
+		}
+		entryData, err := parseStreamEntry(message.Values)
+		if err != nil {
+			// Invalid entries will never succeed, there is no point in keeping them pending
+			log.Printf("failed to decode entry element: %v -> %s", err, message.Values)
+			ackPendingStreamEntries(client, streamName, groupName, message.ID)
+			continue
+		}
+		entryData.Retries = int(deliveries[message.ID])
+		if lastError, err := client.HGet(ctx, errorsKey, message.ID).Result(); err == nil {
+			entryData.LastError = lastError
+		}
+		// Entries delivered more than the allowed retries have failed already, but
+		// moving them to the dead-letter stream didn't succeed last time
+		if entryData.Retries > options.Retries {
+			exhausted = append(exhausted, *entryData)
+			exhaustedIds = append(exhaustedIds, message.ID)
+			continue
+		}
+		batch = append(batch, *entryData.withMaxRetries(options.Retries))
+		batchIds = append(batchIds, message.ID)
+	}
+
+	if len(batch) > 0 {
+		entryErrs := consumerFn(batch, consumerId)
+		succeededIds := []string{}
+		for i := range batch {
+			entryErr := streamEntryError(entryErrs, i)
+			if entryErr == nil {
+				succeededIds = append(succeededIds, batchIds[i])
+				continue
+			}
+			entryData := batch[i].WithError(entryErr.Error())
+			// Entries that can't be decoded will never succeed
+			if entryData.Retries < options.Retries && !errors.Is(entryErr, ErrDecode) {
+				// Keeps the entry pending, it will be claimed back once it's idle for long enough
+				if err := client.HSet(ctx, errorsKey, batchIds[i], entryData.LastError).Err(); err != nil {
+					log.Printf("failed to store the error of stream entry %s: %v", batchIds[i], err)
+				}
+				continue
+			}
+			exhausted = append(exhausted, *entryData)
+			exhaustedIds = append(exhaustedIds, batchIds[i])
+		}
+		if len(succeededIds) > 0 {
+			ackPendingStreamEntries(client, streamName, groupName, succeededIds...)
+		}
+	}
+
+	for i, entryData := range exhausted {
+		messageId := exhaustedIds[i]
+		if err := deadLetterStreamEntry(client, consumerId, streamName, groupName, options, messageId, entryData); err != nil {
+			// Keeps the entry pending to move it to the dead-letter stream on the next retry
+			log.Printf("consumer '%s' failed to process stream '%s' entry -> %s: %v", consumerId, streamName, entryData.Value, err)
+			if err := client.HSet(ctx, errorsKey, messageId, entryData.LastError).Err(); err != nil {
+				log.Printf("failed to store the error of stream entry %s: %v", messageId, err)
+			}
+			continue
+		}
+		ackPendingStreamEntries(client, streamName, groupName, messageId)
+	}
+}
+
+func ackPendingStreamEntries(client *RedisClient, streamName string, groupName string, messageIds ...string) {
+	ctx := context.Background()
+	if err := client.XAck(ctx, streamName, groupName, messageIds...).Err(); err != nil {
+		log.Printf("failed to ack stream entries %v: %v", messageIds, err)
+		return
+	}
+	if err := client.HDel(ctx, streamErrorsKey(streamName, groupName), messageIds...).Err(); err != nil {
+		log.Printf("failed to clean up the errors of stream entries %v: %v", messageIds, err)
+	}
+}
+
+// streamEntryError returns the error of the batch entry at the index,
+// missing errors mean the entry was processed successfully
+func streamEntryError(errs []error, i int) error {
+	if i < len(errs) {
+		return errs[i]
+	}
+	return nil
+}
+
+// batchStreamConsumer processes the entries of a batch one by one with the consumer
+func batchStreamConsumer(consumerFn StreamConsumerFunc) StreamBatchConsumerFunc {
+	return func(entries []XStreamEntry, consumerId string) []error {
+		errs := make([]error, len(entries))
+		for i := range entries {
+			errs[i] = consumerFn(entries[i], consumerId)
+		}
+		return errs
+	}
+}
+
+// sleepUntilShutdown waits for the given duration or until shutdown is cancelled,
+// whichever comes first
+func sleepUntilShutdown(shutdown context.Context, d time.Duration) {
+	select {
+	case <-shutdown.Done():
+	case <-time.After(d):
+	}
+}
+
+func internalStreamAppend(client *RedisClient, streamName string, values map[string]interface{}) error {
+	return internalStreamAppendWithRetention(client, streamName, values, nil)
+}
+
+func internalStreamAppendWithRetention(client *RedisClient, streamName string, values map[string]interface{}, retention *StreamRetention) error {
+	args := &redis.XAddArgs{
+		Stream: streamName,
+		ID:     "",
+		Values: values,
+	}
+	if retention.isEnabled() {
+		// Redis accepts only one trimming strategy per command
+		if retention.MaxLen > 0 {
+			args.MaxLen = retention.MaxLen
+		} else {
+			args.MinID = retention.minId(time.Now())
+		}
+		args.Approx = retention.Approx
+	}
+
+	err := client.XAdd(context.Background(), args).Err()
 	if err != nil {
 		return fmt.Errorf("%w: %v", ErrStreamAppend, err)
 	}
@@ -134,8 +466,32 @@ func internalStreamAppend(depsCtx context.Context, streamName string, values map
 }
 
 func StreamAppend(depsCtx context.Context, streamName string, value string) (entryRef uuid.UUID, err error) {
+	return StreamAppendWithOptions(depsCtx, streamName, value, nil)
+}
+
+// StreamAppendOptions contains details of how an entry is appended to the stream
+type StreamAppendOptions struct {
+	// Retention trims the stream while appending, unlike the trimmer of the consumers
+	// it doesn't take the pending entries of the consumer groups into account
+	Retention *StreamRetention
+	// Headers are attached to the entry and kept through its retries,
+	// HeaderCreatedAt is set to the current time if it's not provided
+	Headers map[string]string
+}
+
+func StreamAppendWithOptions(depsCtx context.Context, streamName string, value string, options *StreamAppendOptions) (entryRef uuid.UUID, err error) {
+	client, err := GetClient(depsCtx)
+	if err != nil {
+		return entryRef, fmt.Errorf("%w: %v", ErrStreamAppend, err)
+	}
+	if options == nil {
+		options = &StreamAppendOptions{}
+	}
 	entryRef = uuid.New()
-	err = internalStreamAppend(depsCtx, streamName, newStreamEntry(entryRef, value, 0, "").Build())
+	entry := newStreamEntry(entryRef, value, 0, "").
+		WithHeaders(map[string]string{HeaderCreatedAt: time.Now().UTC().Format(time.RFC3339Nano)}).
+		WithHeaders(options.Headers)
+	err = internalStreamAppendWithRetention(client, streamName, entry.Build(), options.Retention)
 	return entryRef, err
 }
 
@@ -0,0 +1,166 @@
+package xredis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const deadLetterSerializedKey = "serializedDeadLetter"
+
+var ErrStreamDeadLetter = errors.New("dead letter")
+
+// XStreamDeadLetter is a stream entry that has exhausted its retries
+type XStreamDeadLetter struct {
+	// Id of the dead letter in the dead-letter stream
+	Id string `json:"-"`
+
+	Entry      XStreamEntry `json:"entry"`
+	Stream     string       `json:"stream"`
+	Group      string       `json:"group"`
+	ConsumerId string       `json:"consumerId"`
+	MessageId  string       `json:"messageId"` // id of the entry in the original stream
+	CreatedAt  time.Time    `json:"createdAt"`
+	FailedAt   time.Time    `json:"failedAt"`
+}
+
+// DeadLetterStreamName returns the default name of the dead-letter stream of a stream
+func DeadLetterStreamName(streamName string) string {
+	return streamName + ":dlq"
+}
+
+// ListStreamDeadLetters returns up to count dead letters, oldest first
+func ListStreamDeadLetters(depsCtx context.Context, deadLetterStream string, count int64) ([]XStreamDeadLetter, error) {
+	client, err := GetClient(depsCtx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStreamDeadLetter, err)
+	}
+	messages, err := client.XRangeN(context.Background(), deadLetterStream, "-", "+", count).Result()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStreamDeadLetter, err)
+	}
+
+	deadLetters := []XStreamDeadLetter{}
+	for _, m := range messages {
+		deadLetter, err := parseStreamDeadLetter(m)
+		if err != nil {
+			log.Printf("failed to decode dead letter %s: %v", m.ID, err)
+			continue
+		}
+		deadLetters = append(deadLetters, *deadLetter)
+	}
+	return deadLetters, nil
+}
+
+// GetStreamDeadLetter returns the dead letter by its id in the dead-letter stream
+func GetStreamDeadLetter(depsCtx context.Context, deadLetterStream string, id string) (*XStreamDeadLetter, error) {
+	client, err := GetClient(depsCtx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStreamDeadLetter, err)
+	}
+	return getStreamDeadLetter(client, deadLetterStream, id)
+}
+
+// ReplayStreamDeadLetter appends the entry of the dead letter back to its original stream
+// with its retries reset, and removes it from the dead-letter stream
+func ReplayStreamDeadLetter(depsCtx context.Context, deadLetterStream string, id string) error {
+	client, err := GetClient(depsCtx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStreamDeadLetter, err)
+	}
+	deadLetter, err := getStreamDeadLetter(client, deadLetterStream, id)
+	if err != nil {
+		return err
+	}
+
+	entry := deadLetter.Entry
+	entry.Retries = 0
+	if err := internalStreamAppend(client, deadLetter.Stream, entry.Build()); err != nil {
+		return fmt.Errorf("%w: %v", ErrStreamDeadLetter, err)
+	}
+	if err := client.XDel(context.Background(), deadLetterStream, id).Err(); err != nil {
+		return fmt.Errorf("%w: failed to remove replayed dead letter %s: %v", ErrStreamDeadLetter, id, err)
+	}
+	return nil
+}
+
+// PurgeStreamDeadLetters removes the given dead letters, or all of them if no ids are provided
+func PurgeStreamDeadLetters(depsCtx context.Context, deadLetterStream string, ids ...string) error {
+	client, err := GetClient(depsCtx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStreamDeadLetter, err)
+	}
+	if len(ids) == 0 {
+		err = client.Del(context.Background(), deadLetterStream).Err()
+	} else {
+		err = client.XDel(context.Background(), deadLetterStream, ids...).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStreamDeadLetter, err)
+	}
+	return nil
+}
+
+func deadLetterStreamEntry(
+	client *RedisClient,
+	consumerId string,
+	streamName string,
+	groupName string,
+	options StreamConsumerOptions,
+	messageId string,
+	entry XStreamEntry,
+) error {
+	b, _ := json.Marshal(XStreamDeadLetter{
+		Entry:      entry,
+		Stream:     streamName,
+		Group:      groupName,
+		ConsumerId: consumerId,
+		MessageId:  messageId,
+		CreatedAt:  streamIdTime(messageId),
+		FailedAt:   time.Now(),
+	})
+	err := client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: options.DeadLetterStream,
+		Values: map[string]interface{}{deadLetterSerializedKey: b},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStreamDeadLetter, err)
+	}
+	log.Printf("consumer '%s' moved stream '%s' entry %s to '%s' after %d retries: %s", consumerId, streamName, entry.Id, options.DeadLetterStream, entry.Retries, entry.LastError)
+	return nil
+}
+
+func getStreamDeadLetter(client *RedisClient, deadLetterStream string, id string) (*XStreamDeadLetter, error) {
+	messages, err := client.XRangeN(context.Background(), deadLetterStream, id, id, 1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStreamDeadLetter, err)
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("%w: %s not found", ErrStreamDeadLetter, id)
+	}
+	return parseStreamDeadLetter(messages[0])
+}
+
+func parseStreamDeadLetter(m redis.XMessage) (*XStreamDeadLetter, error) {
+	var serializedValue []byte
+	switch v := m.Values[deadLetterSerializedKey].(type) {
+	case string:
+		serializedValue = []byte(v)
+	case []byte:
+		serializedValue = v
+	default:
+		return nil, fmt.Errorf("%w: invalid input value %T", ErrStreamDeadLetter, m.Values[deadLetterSerializedKey])
+	}
+
+	var deadLetter XStreamDeadLetter
+	if err := json.Unmarshal(serializedValue, &deadLetter); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStreamDeadLetter, err)
+	}
+	deadLetter.Id = m.ID
+	return &deadLetter, nil
+}
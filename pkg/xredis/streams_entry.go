@@ -9,12 +9,23 @@ import (
 
 const entrySerializedElementKey = "serializedEntryElement"
 
+// Well-known headers of the stream entries
+const (
+	HeaderContentType   = "content-type"
+	HeaderCorrelationId = "correlation-id"
+	HeaderCausationId   = "causation-id"
+	HeaderProducer      = "producer"
+	HeaderCreatedAt     = "created-at"
+	HeaderSchemaVersion = "schema-version"
+)
+
 type XStreamEntry struct {
 	maxRetries int
-	Id         uuid.UUID `json:"id"`
-	LastError  string    `json:"lastError"`
-	Retries    int       `json:"retries"`
-	Value      string    `json:"value"`
+	Id         uuid.UUID         `json:"id"`
+	LastError  string            `json:"lastError"`
+	Retries    int               `json:"retries"`
+	Value      string            `json:"value"`
+	Headers    map[string]string `json:"headers,omitempty"`
 }
 
 func (se *XStreamEntry) Build() map[string]interface{} {
@@ -38,6 +49,24 @@ func (se *XStreamEntry) IsLastTry() bool {
 	return se.Retries >= se.maxRetries
 }
 
+// Header returns the value of the header, or an empty string if it's not set
+func (se *XStreamEntry) Header(key string) string {
+	return se.Headers[key]
+}
+
+func (se *XStreamEntry) WithHeaders(headers map[string]string) *XStreamEntry {
+	if len(headers) == 0 {
+		return se
+	}
+	if se.Headers == nil {
+		se.Headers = make(map[string]string, len(headers))
+	}
+	for k, v := range headers {
+		se.Headers[k] = v
+	}
+	return se
+}
+
 func (se *XStreamEntry) WithError(err string) *XStreamEntry {
 	se.LastError = err
 	return se
@@ -0,0 +1,57 @@
+package xredis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseStreamId splits a stream entry id into its milliseconds and sequence parts
+func parseStreamId(id string) (ms uint64, seq uint64, err error) {
+	parts := strings.SplitN(id, "-", 2)
+	if ms, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid stream id '%s': %v", id, err)
+	}
+	if len(parts) == 2 {
+		if seq, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid stream id '%s': %v", id, err)
+		}
+	}
+	return ms, seq, nil
+}
+
+// nextStreamId returns the smallest possible id after the given one,
+// it is used for paginating over inclusive ranges
+func nextStreamId(id string) string {
+	ms, seq, err := parseStreamId(id)
+	if err != nil {
+		return id
+	}
+	return fmt.Sprintf("%d-%d", ms, seq+1)
+}
+
+// lowerStreamId returns the lower of the two stream ids
+func lowerStreamId(a string, b string) string {
+	aMs, aSeq, aErr := parseStreamId(a)
+	bMs, bSeq, bErr := parseStreamId(b)
+	if aErr != nil {
+		return b
+	}
+	if bErr != nil {
+		return a
+	}
+	if bMs < aMs || (bMs == aMs && bSeq < aSeq) {
+		return b
+	}
+	return a
+}
+
+// streamIdTime returns the time a stream entry was added by its id
+func streamIdTime(id string) time.Time {
+	ms, _, err := parseStreamId(id)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
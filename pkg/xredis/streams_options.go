@@ -1,20 +1,97 @@
 package xredis
 
+import "time"
+
+const defaultStreamReadCount = 2
+const defaultStreamReadBlock = time.Second
+
 // StreamConsumerOptions contains details of how steram consumer should be running
 type StreamConsumerOptions struct {
 	Counts  uint // amount of the consumers
 	Retries int  // amount of retries for consumer entries processing
+
+	// ConsumerPrefix is the prefix of the consumer ids, defaults to the group name
+	ConsumerPrefix string
+
+	ReadCount   int64         // maximum amount of entries read at once
+	ReadBlock   time.Duration // how long a read waits for new entries, it's also how quickly consumers notice the shutdown
+	IdleBackoff time.Duration // how long a consumer pauses after a read without any entries
+
+	// AtLeastOnce keeps the entries in the pending entries list of the group until the
+	// consumer returns nil, failed entries are retried from there using their delivery count
+	// instead of being appended to the stream again
+	AtLeastOnce bool
+	// RetryIdle is how long a failed entry stays pending before it's retried
+	RetryIdle time.Duration
+	// RetryBackoff delays the retries of failed entries, they become visible to the consumers
+	// again only after their delay. In at-least-once mode the entries stay pending for the
+	// delay, otherwise they are kept in a sorted set until the scheduler appends them back.
+	RetryBackoff Backoff
+	// ScheduleInterval is how often the scheduler appends the due entries, defaults to a second
+	ScheduleInterval time.Duration
+
+	// ReclaimMinIdle enables the reclaimer, entries pending on other consumers for at least
+	// this long are handed over to the live consumers. It should be well above RetryIdle and
+	// the longest processing time of an entry, otherwise entries of live consumers are stolen.
+	ReclaimMinIdle time.Duration
+	// ReclaimInterval is how often the reclaimer runs, defaults to ReclaimMinIdle
+	ReclaimInterval time.Duration
+	// DeadConsumerIdle removes the consumers of the group without pending entries that
+	// have been idle for at least this long, zero keeps them
+	DeadConsumerIdle time.Duration
+
+	// DeadLetterStream receives the entries that have exhausted their retries,
+	// defaults to DeadLetterStreamName of the consumed stream
+	DeadLetterStream string
+
+	// Retention enables the trimmer which periodically removes the entries out of the
+	// retention, the entries pending in any of the consumer groups are never trimmed
+	Retention *StreamRetention
+	// TrimInterval is how often the trimmer runs, defaults to a minute
+	TrimInterval time.Duration
 }
 
 func (sco *StreamConsumerOptions) Normalize() {
 	if sco.Counts < 1 {
 		sco.Counts = 1
 	}
+	if sco.ReadCount < 1 {
+		sco.ReadCount = defaultStreamReadCount
+	}
+	if sco.ReadBlock <= 0 {
+		sco.ReadBlock = defaultStreamReadBlock
+	}
+	if sco.IdleBackoff < 0 {
+		sco.IdleBackoff = 0
+	}
+	if sco.RetryIdle < 0 {
+		sco.RetryIdle = 0
+	}
+	if sco.ScheduleInterval <= 0 {
+		sco.ScheduleInterval = time.Second
+	}
+	if sco.TrimInterval <= 0 {
+		sco.TrimInterval = time.Minute
+	}
+	if sco.ReclaimMinIdle > 0 && sco.ReclaimInterval <= 0 {
+		sco.ReclaimInterval = sco.ReclaimMinIdle
+	}
 }
 
 func NewStreamConsumerOptions(counts uint, retries int) *StreamConsumerOptions {
 	return &StreamConsumerOptions{
-		Counts:  counts,
-		Retries: retries,
+		Counts:    counts,
+		Retries:   retries,
+		ReadCount: defaultStreamReadCount,
+		ReadBlock: defaultStreamReadBlock,
+		RetryIdle: time.Second * 5,
+	}
+}
+
+// retryDelay returns how long the entry should wait before its next retry
+func (sco *StreamConsumerOptions) retryDelay(retries int) time.Duration {
+	if sco.RetryBackoff == nil {
+		return 0
 	}
+	return sco.RetryBackoff.Delay(retries)
 }
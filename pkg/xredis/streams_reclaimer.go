@@ -0,0 +1,180 @@
+package xredis
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// streamPendingBatch is the amount of pending entries inspected per page
+const streamPendingBatch = 100
+
+// runStreamReclaimer periodically hands the entries left pending on dead consumers over to
+// the live consumers of this process and removes the dead consumers from the group
+func runStreamReclaimer(
+	client *RedisClient,
+	shutdown context.Context,
+	streamName string,
+	groupName string,
+	consumerIds []string,
+	options StreamConsumerOptions,
+) {
+	for {
+		select {
+		case <-shutdown.Done():
+			return
+		case <-time.After(options.ReclaimInterval):
+			internalReclaimStreamEntries(client, streamName, groupName, consumerIds, options)
+			if options.DeadConsumerIdle > 0 {
+				internalRemoveDeadStreamConsumers(client, streamName, groupName, consumerIds, options)
+			}
+		}
+	}
+}
+
+// internalReclaimStreamEntries claims the entries that have been idle for at least
+// ReclaimMinIdle on consumers other than ours. Claimed entries are spread over our
+// consumers and processed by them as pending entries.
+func internalReclaimStreamEntries(
+	client *RedisClient,
+	streamName string,
+	groupName string,
+	consumerIds []string,
+	options StreamConsumerOptions,
+) {
+	ctx := context.Background()
+	live := map[string]struct{}{}
+	for _, id := range consumerIds {
+		live[id] = struct{}{}
+	}
+
+	claimed := 0
+	start := "-"
+	for {
+		pending, err := client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: streamName,
+			Group:  groupName,
+			Start:  start,
+			End:    "+",
+			Count:  streamPendingBatch,
+		}).Result()
+		if err != nil {
+			if err != redis.Nil && !strings.Contains(err.Error(), "NOGROUP") {
+				log.Printf("ERROR: failed to read pending entries of stream '%s': %v", streamName, err)
+			}
+			return
+		}
+
+		for _, p := range pending {
+			if _, ok := live[p.Consumer]; ok || p.Idle < options.ReclaimMinIdle {
+				continue
+			}
+			consumerId := consumerIds[claimed%len(consumerIds)]
+			// MinIdle makes sure we don't steal the entry if its owner has touched it since
+			// we've read the pending entries list. The hand-over keeps the delivery count, it's
+			// bumped once the receiving consumer claims the entry to process it.
+			err := client.Do(
+				ctx,
+				"XCLAIM", streamName, groupName, consumerId,
+				durationToMilliseconds(options.ReclaimMinIdle), p.ID,
+				"RETRYCOUNT", p.RetryCount, "JUSTID",
+			).Err()
+			if err != nil && err != redis.Nil {
+				log.Printf("ERROR: failed to reclaim stream '%s' entry %s from consumer '%s': %v", streamName, p.ID, p.Consumer, err)
+				continue
+			}
+			claimed += 1
+		}
+
+		if len(pending) < streamPendingBatch {
+			break
+		}
+		start = nextStreamId(pending[len(pending)-1].ID)
+	}
+
+	if claimed > 0 {
+		log.Printf("reclaimed %d entries of stream '%s' from dead consumers", claimed, streamName)
+	}
+}
+
+// internalRemoveDeadStreamConsumers deletes the consumers of the group that have no
+// pending entries and have been idle for at least DeadConsumerIdle
+func internalRemoveDeadStreamConsumers(
+	client *RedisClient,
+	streamName string,
+	groupName string,
+	consumerIds []string,
+	options StreamConsumerOptions,
+) {
+	ctx := context.Background()
+	live := map[string]struct{}{}
+	for _, id := range consumerIds {
+		live[id] = struct{}{}
+	}
+
+	consumers, err := readStreamConsumers(client, ctx, streamName, groupName)
+	if err != nil {
+		if !strings.Contains(err.Error(), "NOGROUP") {
+			log.Printf("ERROR: failed to read consumers of stream '%s': %v", streamName, err)
+		}
+		return
+	}
+	for _, c := range consumers {
+		if _, ok := live[c.Name]; ok {
+			continue
+		}
+		// A negative idle time means the server doesn't know when the consumer was last seen
+		if c.Pending > 0 || c.Idle < 0 || c.Idle < options.DeadConsumerIdle {
+			continue
+		}
+		if err := client.XGroupDelConsumer(ctx, streamName, groupName, c.Name).Err(); err != nil {
+			log.Printf("ERROR: failed to remove dead consumer '%s' of stream '%s': %v", c.Name, streamName, err)
+			continue
+		}
+		log.Printf("removed dead consumer '%s' of stream '%s'", c.Name, streamName)
+	}
+}
+
+// streamConsumer is a consumer of a stream group as reported by XINFO CONSUMERS
+type streamConsumer struct {
+	Name    string
+	Pending int64
+	Idle    time.Duration
+}
+
+// readStreamConsumers reads the consumers of the group. The reply is parsed by its field names
+// since Redis 7 reports more fields than the client's XInfoConsumers accepts.
+func readStreamConsumers(client *RedisClient, ctx context.Context, streamName string, groupName string) ([]streamConsumer, error) {
+	reply, err := client.Do(ctx, "XINFO", "CONSUMERS", streamName, groupName).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	consumers := []streamConsumer{}
+	for _, item := range reply {
+		fields, ok := item.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected XINFO CONSUMERS reply: %v", item)
+		}
+		c := streamConsumer{Idle: -1}
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, _ := fields[i].(string)
+			switch key {
+			case "name":
+				c.Name, _ = fields[i+1].(string)
+			case "pending":
+				c.Pending, _ = fields[i+1].(int64)
+			case "idle":
+				if idle, ok := fields[i+1].(int64); ok {
+					c.Idle = time.Duration(idle) * time.Millisecond
+				}
+			}
+		}
+		consumers = append(consumers, c)
+	}
+	return consumers, nil
+}
@@ -0,0 +1,68 @@
+package xredis
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// streamSchedulerBatch is the maximum amount of due entries moved back to the stream at once
+const streamSchedulerBatch = 100
+
+// moveDueStreamEntriesScript moves the due entries of the delayed sorted set back into
+// the stream atomically, so an entry is never lost nor appended twice by concurrent schedulers
+var moveDueStreamEntriesScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, serialized in ipairs(due) do
+	redis.call('XADD', KEYS[2], '*', ARGV[3], serialized)
+	redis.call('ZREM', KEYS[1], serialized)
+end
+return #due
+`)
+
+// scheduleStreamEntry keeps the entry aside until it's due, the scheduler
+// appends it back to the stream afterwards
+func scheduleStreamEntry(client *RedisClient, streamName string, entry *XStreamEntry, dueAt time.Time) error {
+	serialized, _ := json.Marshal(entry)
+	return client.ZAdd(context.Background(), streamDelayedKey(streamName), &redis.Z{
+		Score:  float64(dueAt.UnixNano() / int64(time.Millisecond)),
+		Member: string(serialized),
+	}).Err()
+}
+
+// runStreamScheduler periodically appends the delayed entries that are due back to the stream
+func runStreamScheduler(client *RedisClient, shutdown context.Context, streamName string, options StreamConsumerOptions) {
+	for {
+		select {
+		case <-shutdown.Done():
+			return
+		case <-time.After(options.ScheduleInterval):
+			if err := internalMoveDueStreamEntries(client, streamName); err != nil {
+				log.Printf("ERROR: failed to move due entries of stream '%s': %v", streamName, err)
+			}
+		}
+	}
+}
+
+func internalMoveDueStreamEntries(client *RedisClient, streamName string) error {
+	for {
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		moved, err := moveDueStreamEntriesScript.Run(
+			context.Background(),
+			client,
+			[]string{streamDelayedKey(streamName), streamName},
+			now,
+			streamSchedulerBatch,
+			entrySerializedElementKey,
+		).Int()
+		if err != nil {
+			return err
+		}
+		if moved < streamSchedulerBatch {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,555 @@
+package xredis_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aminpaks/go-streams/pkg/testrun"
+	"github.com/aminpaks/go-streams/pkg/xredis"
+)
+
+func TestStreamConsumer(t *testing.T) {
+	t.Parallel()
+
+	r := testrun.New(t)
+
+	r.Run(
+		r.It("Should close the done channel once shutdown is cancelled", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, _ := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+
+			done, err := xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "group", func(entry xredis.XStreamEntry, consumerId string) error {
+				return nil
+			}, xredis.NewStreamConsumerOptions(2, 3))
+			assert.Nil(err)
+
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(time.Second * 5):
+				assert.Fail("consumers did not shut down")
+			}
+		}),
+
+		r.It("Should keep failed entries pending in at-least-once mode", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			processed := make(chan xredis.XStreamEntry, 1)
+			options := xredis.NewStreamConsumerOptions(1, 3)
+			options.AtLeastOnce = true
+			_, err := xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "group", func(entry xredis.XStreamEntry, consumerId string) error {
+				processed <- entry
+				return errors.New("failed")
+			}, options)
+			assert.Nil(err)
+
+			_, err = xredis.StreamAppend(depsCtx, "stream", "value")
+			assert.Nil(err)
+
+			select {
+			case entry := <-processed:
+				assert.Equal("value", entry.Value)
+				assert.Equal(1, entry.Retries)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+
+			assert.Eventually(func() bool {
+				pending, err := client.XPending(context.Background(), "stream", "group").Result()
+				return err == nil && pending.Count == 1
+			}, time.Second*2, time.Millisecond*10)
+		}),
+
+		r.It("Should move exhausted entries to the dead-letter stream and replay them", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			_, err := xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "group", func(entry xredis.XStreamEntry, consumerId string) error {
+				return errors.New("always failing")
+			}, xredis.NewStreamConsumerOptions(1, 2))
+			assert.Nil(err)
+
+			ref, err := xredis.StreamAppend(depsCtx, "stream", "value")
+			assert.Nil(err)
+
+			dlq := xredis.DeadLetterStreamName("stream")
+			var deadLetters []xredis.XStreamDeadLetter
+			assert.Eventually(func() bool {
+				deadLetters, err = xredis.ListStreamDeadLetters(depsCtx, dlq, 10)
+				return err == nil && len(deadLetters) == 1
+			}, time.Second*5, time.Millisecond*10)
+
+			deadLetter := deadLetters[0]
+			assert.Equal(ref, deadLetter.Entry.Id)
+			assert.Equal(2, deadLetter.Entry.Retries)
+			assert.Equal("always failing", deadLetter.Entry.LastError)
+			assert.Equal("stream", deadLetter.Stream)
+			assert.Equal("group", deadLetter.Group)
+			assert.NotEmpty(deadLetter.ConsumerId)
+			assert.False(deadLetter.FailedAt.Before(deadLetter.CreatedAt))
+
+			cancel()
+			assert.Nil(xredis.ReplayStreamDeadLetter(depsCtx, dlq, deadLetter.Id))
+			length, err := client.XLen(context.Background(), dlq).Result()
+			assert.Nil(err)
+			assert.Equal(int64(0), length)
+
+			assert.Nil(xredis.PurgeStreamDeadLetters(depsCtx, dlq))
+		}),
+
+		r.It("Should hand the entries to the batch consumer and retry the failed ones", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, _ := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			for _, v := range []string{"first", "second", "third"} {
+				_, err := xredis.StreamAppend(depsCtx, "stream", v)
+				assert.Nil(err)
+			}
+
+			processed := make(chan xredis.XStreamEntry, 10)
+			options := xredis.NewStreamConsumerOptions(1, 2)
+			options.ReadCount = 10
+			_, err := xredis.RegisterStreamBatchConsumer(depsCtx, shutdown, "stream", "group", func(entries []xredis.XStreamEntry, consumerId string) []error {
+				errs := make([]error, len(entries))
+				for i, e := range entries {
+					if e.Value == "second" && e.Retries == 1 {
+						errs[i] = errors.New("failed")
+					}
+					processed <- e
+				}
+				return errs
+			}, options)
+			assert.Nil(err)
+
+			values := []string{}
+			for len(values) < 4 {
+				select {
+				case e := <-processed:
+					values = append(values, fmt.Sprintf("%s:%d", e.Value, e.Retries))
+				case <-time.After(time.Second * 5):
+					assert.FailNow("entries were not processed", "%v", values)
+				}
+			}
+			assert.Equal([]string{"first:1", "second:1", "third:1", "second:2"}, values)
+		}),
+
+		r.It("Should delay the retries of failed entries by the backoff", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, _ := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			processed := make(chan xredis.XStreamEntry, 2)
+			options := xredis.NewStreamConsumerOptions(1, 2)
+			options.RetryBackoff = xredis.FixedBackoff(time.Millisecond * 200)
+			options.ScheduleInterval = time.Millisecond * 10
+			_, err := xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "group", func(entry xredis.XStreamEntry, consumerId string) error {
+				processed <- entry
+				if entry.Retries == 1 {
+					return errors.New("failed")
+				}
+				return nil
+			}, options)
+			assert.Nil(err)
+
+			_, err = xredis.StreamAppend(depsCtx, "stream", "value")
+			assert.Nil(err)
+
+			var failedAt time.Time
+			select {
+			case <-processed:
+				failedAt = time.Now()
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+			select {
+			case entry := <-processed:
+				assert.Equal(2, entry.Retries)
+				assert.Equal("failed", entry.LastError)
+				assert.GreaterOrEqual(int64(time.Since(failedAt)), int64(time.Millisecond*150))
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not retried")
+			}
+		}),
+
+		r.It("Should retry the due entries behind the ones still in backoff", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, _ := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			processed := make(chan xredis.XStreamEntry, 10)
+			options := xredis.NewStreamConsumerOptions(1, 5)
+			options.AtLeastOnce = true
+			options.ReadCount = 1
+			options.ReadBlock = time.Millisecond * 10
+			options.RetryIdle = 0
+			// The second retry waits long enough to keep its entry at the head of the list
+			options.RetryBackoff = xredis.BackoffFunc(func(retry int) time.Duration {
+				if retry > 1 {
+					return time.Hour
+				}
+				return time.Millisecond * 10
+			})
+			_, err := xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "group", func(entry xredis.XStreamEntry, consumerId string) error {
+				processed <- entry
+				if entry.Value == "backoff" || entry.Retries == 1 {
+					return errors.New("failed")
+				}
+				return nil
+			}, options)
+			assert.Nil(err)
+
+			for _, v := range []string{"backoff", "due"} {
+				_, err := xredis.StreamAppend(depsCtx, "stream", v)
+				assert.Nil(err)
+			}
+
+			timeout := time.After(time.Second * 5)
+			for {
+				select {
+				case entry := <-processed:
+					if entry.Value == "due" && entry.Retries == 2 {
+						return
+					}
+				case <-timeout:
+					assert.FailNow("due entry was not retried")
+				}
+			}
+		}),
+
+		r.It("Should keep the headers of the entries through retries", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, _ := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			processed := make(chan xredis.XStreamEntry, 2)
+			_, err := xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "group", func(entry xredis.XStreamEntry, consumerId string) error {
+				processed <- entry
+				if entry.Retries == 1 {
+					return errors.New("failed")
+				}
+				return nil
+			}, xredis.NewStreamConsumerOptions(1, 2))
+			assert.Nil(err)
+
+			_, err = xredis.StreamAppendWithOptions(depsCtx, "stream", "value", &xredis.StreamAppendOptions{
+				Headers: map[string]string{xredis.HeaderCorrelationId: "correlation"},
+			})
+			assert.Nil(err)
+
+			for retries := 1; retries <= 2; retries++ {
+				select {
+				case entry := <-processed:
+					assert.Equal(retries, entry.Retries)
+					assert.Equal("correlation", entry.Header(xredis.HeaderCorrelationId))
+					assert.NotEmpty(entry.Header(xredis.HeaderCreatedAt))
+				case <-time.After(time.Second * 5):
+					assert.FailNow("entry was not processed")
+				}
+			}
+		}),
+
+		r.It("Should trim the stream on append by its max length", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			options := &xredis.StreamAppendOptions{Retention: &xredis.StreamRetention{MaxLen: 2}}
+			for i := 0; i < 5; i++ {
+				_, err := xredis.StreamAppendWithOptions(depsCtx, "stream", "value", options)
+				assert.Nil(err)
+			}
+
+			length, err := client.XLen(context.Background(), "stream").Result()
+			assert.Nil(err)
+			assert.Equal(int64(2), length)
+		}),
+
+		r.It("Should trim the consumed stream to its max length", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ctx := context.Background()
+			for i := 0; i < 5; i++ {
+				_, err := xredis.StreamAppend(depsCtx, "stream", "value")
+				assert.Nil(err)
+			}
+			entries, err := client.XRange(ctx, "stream", "-", "+").Result()
+			assert.Nil(err)
+
+			options := xredis.NewStreamConsumerOptions(1, 3)
+			options.Retention = &xredis.StreamRetention{MaxLen: 2}
+			options.TrimInterval = time.Millisecond * 20
+			_, err = xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "group", func(entry xredis.XStreamEntry, consumerId string) error {
+				return nil
+			}, options)
+			assert.Nil(err)
+
+			var kept []redis.XMessage
+			assert.Eventually(func() bool {
+				kept, err = client.XRange(ctx, "stream", "-", "+").Result()
+				return err == nil && len(kept) == 2
+			}, time.Second*5, time.Millisecond*10)
+			assert.Equal(entries[3].ID, kept[0].ID)
+			assert.Equal(entries[4].ID, kept[1].ID)
+		}),
+
+		r.It("Should never trim the pending or undelivered entries", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ctx := context.Background()
+			assert.Nil(client.XGroupCreateMkStream(ctx, "stream", "group", "0").Err())
+			for _, v := range []string{"acked", "pending", "undelivered"} {
+				_, err := xredis.StreamAppend(depsCtx, "stream", v)
+				assert.Nil(err)
+			}
+			ids := []string{}
+			entries, err := client.XRange(ctx, "stream", "-", "+").Result()
+			assert.Nil(err)
+			for _, m := range entries {
+				ids = append(ids, m.ID)
+			}
+			for i := 0; i < 2; i++ {
+				assert.Nil(client.XReadGroup(ctx, &redis.XReadGroupArgs{
+					Group:    "group",
+					Consumer: "consumer",
+					Streams:  []string{"stream", ">"},
+					Count:    1,
+				}).Err())
+			}
+			assert.Nil(client.XAck(ctx, "stream", "group", ids[0]).Err())
+			// All of the entries are out of the retention by now
+			time.Sleep(time.Millisecond * 10)
+
+			options := xredis.NewStreamConsumerOptions(1, 3)
+			options.Retention = &xredis.StreamRetention{MaxLen: 1, MaxAge: time.Millisecond}
+			options.TrimInterval = time.Millisecond * 20
+			_, err = xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "other", func(entry xredis.XStreamEntry, consumerId string) error {
+				return nil
+			}, options)
+			assert.Nil(err)
+
+			var kept []redis.XMessage
+			assert.Eventually(func() bool {
+				kept, err = client.XRange(ctx, "stream", "-", "+").Result()
+				return err == nil && len(kept) < 3
+			}, time.Second*5, time.Millisecond*10)
+			// Gives the trimmer another few runs
+			time.Sleep(time.Millisecond * 100)
+			kept, err = client.XRange(ctx, "stream", "-", "+").Result()
+			assert.Nil(err)
+			keptIds := []string{}
+			for _, m := range kept {
+				keptIds = append(keptIds, m.ID)
+			}
+			assert.Equal(ids[1:], keptIds)
+		}),
+
+		r.It("Should hand the entries of dead consumers over to the live ones", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ctx := context.Background()
+			assert.Nil(client.XGroupCreateMkStream(ctx, "stream", "group", "0").Err())
+			_, err := xredis.StreamAppend(depsCtx, "stream", "value")
+			assert.Nil(err)
+			// The entry stays pending on a consumer that's gone
+			assert.Nil(client.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    "group",
+				Consumer: "dead-1",
+				Streams:  []string{"stream", ">"},
+				Count:    1,
+			}).Err())
+
+			type processedEntry struct {
+				entry      xredis.XStreamEntry
+				consumerId string
+			}
+			processed := make(chan processedEntry, 1)
+			options := xredis.NewStreamConsumerOptions(1, 3)
+			options.ReclaimMinIdle = time.Millisecond * 100
+			options.RetryIdle = time.Millisecond * 10
+			_, err = xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "group", func(entry xredis.XStreamEntry, consumerId string) error {
+				processed <- processedEntry{entry, consumerId}
+				return nil
+			}, options)
+			assert.Nil(err)
+
+			select {
+			case p := <-processed:
+				assert.Equal("value", p.entry.Value)
+				assert.NotEqual("dead-1", p.consumerId)
+				// One delivery to the dead consumer and one to the live one
+				assert.Equal(2, p.entry.Retries)
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not reclaimed")
+			}
+
+			assert.Eventually(func() bool {
+				pending, err := client.XPending(ctx, "stream", "group").Result()
+				return err == nil && pending.Count == 0
+			}, time.Second*2, time.Millisecond*10)
+		}),
+
+		r.It("Should never reclaim the entries of the live consumers", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			started := make(chan string, 2)
+			release := make(chan struct{})
+			defer close(release)
+			options := xredis.NewStreamConsumerOptions(2, 3)
+			options.AtLeastOnce = true
+			options.ReclaimMinIdle = time.Millisecond * 50
+			_, err := xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "group", func(entry xredis.XStreamEntry, consumerId string) error {
+				started <- consumerId
+				<-release
+				return nil
+			}, options)
+			assert.Nil(err)
+
+			_, err = xredis.StreamAppend(depsCtx, "stream", "value")
+			assert.Nil(err)
+
+			var consumerId string
+			select {
+			case consumerId = <-started:
+			case <-time.After(time.Second * 5):
+				assert.FailNow("entry was not processed")
+			}
+
+			// The entry outlives ReclaimMinIdle while its consumer is busy with it
+			select {
+			case id := <-started:
+				assert.Fail("entry was reclaimed", "by consumer '%s'", id)
+			case <-time.After(time.Millisecond * 300):
+			}
+			pending, err := client.XPendingExt(context.Background(), &redis.XPendingExtArgs{
+				Stream: "stream",
+				Group:  "group",
+				Start:  "-",
+				End:    "+",
+				Count:  10,
+			}).Result()
+			assert.Nil(err)
+			assert.Len(pending, 1)
+			if len(pending) == 1 {
+				assert.Equal(consumerId, pending[0].Consumer)
+				assert.Equal(int64(1), pending[0].RetryCount)
+			}
+		}),
+
+		r.It("Should remove only the idle consumers without pending entries", func(t *testing.T) {
+			assert := assert.New(t)
+
+			depsCtx, client := buildStreamTestMocks(t)
+			shutdown, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ctx := context.Background()
+			assert.Nil(client.XGroupCreateMkStream(ctx, "stream", "group", "0").Err())
+			_, err := xredis.StreamAppend(depsCtx, "stream", "value")
+			assert.Nil(err)
+			assert.Nil(client.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    "group",
+				Consumer: "dead-pending",
+				Streams:  []string{"stream", ">"},
+				Count:    1,
+			}).Err())
+			// XCLAIM of a missing entry only creates the consumer, the live one is idle
+			// as well until it reads anything
+			liveId := xredis.ConsumerId("group", 1)
+			for _, consumer := range []string{"dead-empty", liveId} {
+				assert.Nil(client.XClaim(ctx, &redis.XClaimArgs{
+					Stream:   "stream",
+					Group:    "group",
+					Consumer: consumer,
+					Messages: []string{"0-1"},
+				}).Err())
+			}
+
+			options := xredis.NewStreamConsumerOptions(1, 3)
+			// Nothing is idle long enough to be reclaimed
+			options.ReclaimMinIdle = time.Hour
+			options.ReclaimInterval = time.Millisecond * 20
+			options.DeadConsumerIdle = time.Millisecond * 50
+			_, err = xredis.RegisterStreamConsumer(depsCtx, shutdown, "stream", "group", func(entry xredis.XStreamEntry, consumerId string) error {
+				return nil
+			}, options)
+			assert.Nil(err)
+
+			assert.Eventually(func() bool {
+				return !streamConsumerNames(client, "stream", "group")["dead-empty"]
+			}, time.Second*5, time.Millisecond*10)
+			names := streamConsumerNames(client, "stream", "group")
+			assert.True(names["dead-pending"])
+			assert.True(names[liveId])
+		}),
+	)
+}
+
+func buildStreamTestMocks(t *testing.T) (context.Context, *redis.Client) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.FailNow()
+		return nil, nil
+	}
+	t.Cleanup(mr.Close)
+
+	client := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+	return xredis.SetClientContext(context.Background(), client), client
+}
+
+// streamConsumerNames reads the consumer names with a plain XINFO CONSUMERS, the client's
+// XInfoConsumers doesn't accept the fields of newer servers
+func streamConsumerNames(client *redis.Client, stream, group string) map[string]bool {
+	names := map[string]bool{}
+	consumers, _ := client.Do(context.Background(), "XINFO", "CONSUMERS", stream, group).Slice()
+	for _, c := range consumers {
+		fields, _ := c.([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fields[i] == "name" {
+				names[fmt.Sprint(fields[i+1])] = true
+			}
+		}
+	}
+	return names
+}
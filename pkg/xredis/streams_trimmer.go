@@ -0,0 +1,146 @@
+package xredis
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// StreamRetention describes which entries a stream keeps
+type StreamRetention struct {
+	MaxLen int64         // keeps at most MaxLen of the newest entries, zero disables it
+	MaxAge time.Duration // keeps the entries added within MaxAge, zero disables it
+	Approx bool          // lets Redis trim whole nodes only, which is much more efficient
+}
+
+func (sr *StreamRetention) isEnabled() bool {
+	return sr != nil && (sr.MaxLen > 0 || sr.MaxAge > 0)
+}
+
+// minId returns the id of the oldest entry the retention age keeps
+func (sr *StreamRetention) minId(now time.Time) string {
+	return fmt.Sprintf("%d-0", now.Add(-sr.MaxAge).UnixNano()/int64(time.Millisecond))
+}
+
+// runStreamTrimmer periodically trims the stream according to the retention
+func runStreamTrimmer(client *RedisClient, shutdown context.Context, streamName string, options StreamConsumerOptions) {
+	for {
+		select {
+		case <-shutdown.Done():
+			return
+		case <-time.After(options.TrimInterval):
+			if err := internalTrimStream(client, streamName, *options.Retention); err != nil {
+				log.Printf("ERROR: failed to trim stream '%s': %v", streamName, err)
+			}
+		}
+	}
+}
+
+// internalTrimStream removes the entries that are out of the retention, but never the ones
+// that are pending or not yet delivered in any of the consumer groups of the stream
+func internalTrimStream(client *RedisClient, streamName string, retention StreamRetention) error {
+	ctx := context.Background()
+
+	minId := ""
+	if retention.MaxAge > 0 {
+		minId = retention.minId(time.Now())
+	}
+	if retention.MaxLen > 0 {
+		length, err := client.XLen(ctx, streamName).Result()
+		if err != nil {
+			return err
+		}
+		if length <= retention.MaxLen {
+			// The stream is within its max length
+			if retention.MaxAge <= 0 {
+				return nil
+			}
+		} else {
+			// Only the entries out of the max length and the oldest one kept are read
+			oldest, err := client.XRangeN(ctx, streamName, "-", "+", length-retention.MaxLen+1).Result()
+			if err != nil {
+				return err
+			}
+			if len(oldest) > 0 {
+				if kept := oldest[len(oldest)-1].ID; minId == "" || lowerStreamId(minId, kept) == minId {
+					// Keeps whichever of the limits removes more entries
+					minId = kept
+				}
+			}
+		}
+	}
+	if minId == "" {
+		return nil
+	}
+
+	groups, err := readStreamGroups(client, ctx, streamName)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return nil
+		}
+		return err
+	}
+	for _, g := range groups {
+		if g.Pending > 0 {
+			pending, err := client.XPending(ctx, streamName, g.Name).Result()
+			if err != nil {
+				return err
+			}
+			minId = lowerStreamId(minId, pending.Lower)
+		}
+		// Entries after the last delivered one haven't been read by the group yet
+		minId = lowerStreamId(minId, nextStreamId(g.LastDeliveredId))
+	}
+
+	if retention.Approx {
+		err = client.XTrimMinIDApprox(ctx, streamName, minId, 0).Err()
+	} else {
+		err = client.XTrimMinID(ctx, streamName, minId).Err()
+	}
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	return nil
+}
+
+// streamGroup is a consumer group of a stream as reported by XINFO GROUPS
+type streamGroup struct {
+	Name            string
+	Pending         int64
+	LastDeliveredId string
+}
+
+// readStreamGroups reads the consumer groups of the stream. The reply is parsed by its field
+// names since Redis 7 reports more fields than the client's XInfoGroups accepts.
+func readStreamGroups(client *RedisClient, ctx context.Context, streamName string) ([]streamGroup, error) {
+	reply, err := client.Do(ctx, "XINFO", "GROUPS", streamName).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []streamGroup{}
+	for _, item := range reply {
+		fields, ok := item.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected XINFO GROUPS reply: %v", item)
+		}
+		g := streamGroup{}
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, _ := fields[i].(string)
+			switch key {
+			case "name":
+				g.Name, _ = fields[i+1].(string)
+			case "pending":
+				g.Pending, _ = fields[i+1].(int64)
+			case "last-delivered-id":
+				g.LastDeliveredId, _ = fields[i+1].(string)
+			}
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
@@ -0,0 +1,49 @@
+package xredis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// StreamValueConsumerFunc processes the decoded value of a stream entry
+type StreamValueConsumerFunc func(value interface{}, entry XStreamEntry, consumerId string) error
+
+// StreamAppendValue encodes the value with the codec and appends it to the stream,
+// the content type of the codec is attached to the entry as HeaderContentType
+func StreamAppendValue(depsCtx context.Context, streamName string, codec Codec, value interface{}, options *StreamAppendOptions) (entryRef uuid.UUID, err error) {
+	encoded, err := EncodeValue(codec, value)
+	if err != nil {
+		return entryRef, fmt.Errorf("%w: %v", ErrStreamAppend, err)
+	}
+
+	appendOptions := StreamAppendOptions{}
+	if options != nil {
+		appendOptions = *options
+	}
+	headers := map[string]string{}
+	for k, v := range appendOptions.Headers {
+		headers[k] = v
+	}
+	headers[HeaderContentType] = codec.ContentType()
+	appendOptions.Headers = headers
+
+	return StreamAppendWithOptions(depsCtx, streamName, encoded, &appendOptions)
+}
+
+// NewStreamValueConsumer decodes the entries with the codec into the values made by newValue
+// before handing them to the consumer. Entries that can't be decoded are never retried, they
+// are moved to the dead-letter stream right away.
+func NewStreamValueConsumer(codec Codec, newValue func() interface{}, consumerFn StreamValueConsumerFunc) StreamConsumerFunc {
+	return func(entry XStreamEntry, consumerId string) error {
+		if contentType := entry.Header(HeaderContentType); contentType != "" && contentType != codec.ContentType() {
+			return fmt.Errorf("%w: unexpected content type '%s'", ErrDecode, contentType)
+		}
+		value := newValue()
+		if err := DecodeValue(codec, entry.Value, value); err != nil {
+			return err
+		}
+		return consumerFn(value, entry, consumerId)
+	}
+}